@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ae0000/gorhythmbox/rhythmbox"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+)
+
+// Everything under here is JSON, and only changes in ways that won't break
+// clients. Anything that would gets a new version. Requests that change
+// something have to be sent as application/json, see csrf.
+const apiPrefix = "/api/v1"
+
+// Paging, when the client doesn't say
+const (
+	apiLimit    = 50
+	apiMaxLimit = 500
+)
+
+type ApiTrack struct {
+	Id          int     `json:"id"`
+	Title       string  `json:"title"`
+	Artist      string  `json:"artist"`
+	Album       string  `json:"album"`
+	AlbumId     int     `json:"albumId"`
+	Genre       string  `json:"genre"`
+	TrackNumber int     `json:"trackNumber"`
+	Year        int     `json:"year"`
+	Duration    int     `json:"duration"` // Seconds
+	Rating      int     `json:"rating"`
+	PlayCount   int     `json:"playCount"`
+	BPM         float64 `json:"bpm,omitempty"`
+}
+
+// An album, artist or genre. Ids are those of a track in it.
+type ApiItem struct {
+	Id     int        `json:"id"`
+	Name   string     `json:"name"`
+	Artist string     `json:"artist,omitempty"` // Albums only
+	Year   int        `json:"year,omitempty"`
+	Genre  string     `json:"genre,omitempty"`
+	Count  int        `json:"count,omitempty"` // Tracks by an artist or in a genre
+	Image  string     `json:"image,omitempty"`
+	Albums []ApiItem  `json:"albums,omitempty"` // Only when asking for one artist
+	Tracks []ApiTrack `json:"tracks,omitempty"` // Only when asking for one album or genre
+}
+
+type ApiPage struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"` // Matching, before paging
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+type ApiQueueEntry struct {
+	Position int      `json:"position"`
+	Track    ApiTrack `json:"track"`
+}
+
+// Every error looks like this, whatever went wrong
+type ApiError struct {
+	Error ApiErrorBody `json:"error"`
+}
+
+type ApiErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// What PATCH /player can change, anything left out stays as it is
+type ApiPlayerChange struct {
+	Paused   *bool    `json:"paused"`
+	Volume   *float64 `json:"volume"`
+	Shuffle  *bool    `json:"shuffle"`
+	Repeat   *bool    `json:"repeat"`
+	Position *int     `json:"position"` // Seconds into the track
+	Rating   *int     `json:"rating"`
+}
+
+// What can be put in the queue
+type ApiQueueAdd struct {
+	Track int  `json:"track"`
+	Next  bool `json:"next"` // Play after the current track, not at the end
+}
+
+type ApiQueueMove struct {
+	Position int `json:"position"`
+}
+
+func apiError(r render.Render, status int, message string) {
+	r.JSON(status, ApiError{ApiErrorBody{Status: status, Message: message}})
+}
+
+// 404 for things that aren't in the library, 400 for anything else
+func apiLookupError(r render.Render, err error) {
+	if rhythmbox.IsNotFound(err) {
+		apiError(r, 404, err.Error())
+		return
+	}
+	apiError(r, 400, err.Error())
+}
+
+func apiRoutes(m *martini.ClassicMartini, rb *rhythmbox.Client, dj, admin martini.Handler) {
+	m.Get(apiPrefix+"/tracks", func(r render.Render, req *http.Request) {
+		q := req.URL.Query()
+		albumIds := apiAlbumIds(rb)
+		tracks := []ApiTrack{}
+		for _, e := range rb.Db.Entries {
+			if e.Type == "song" && apiMatch(q, e) && apiSearch(q, e.Title, e.Artist, e.Album) {
+				tracks = append(tracks, apiTrack(albumIds, e))
+			}
+		}
+
+		sorts := map[string]func(a, b ApiTrack) bool{
+			"title":     func(a, b ApiTrack) bool { return a.Title < b.Title },
+			"artist":    func(a, b ApiTrack) bool { return a.Artist < b.Artist },
+			"album":     func(a, b ApiTrack) bool { return a.Album < b.Album },
+			"year":      func(a, b ApiTrack) bool { return a.Year < b.Year },
+			"duration":  func(a, b ApiTrack) bool { return a.Duration < b.Duration },
+			"rating":    func(a, b ApiTrack) bool { return a.Rating < b.Rating },
+			"playCount": func(a, b ApiTrack) bool { return a.PlayCount < b.PlayCount },
+		}
+		key, desc := apiSort(q, "")
+		if len(key) > 0 {
+			less, ok := sorts[key]
+			if !ok {
+				apiError(r, 400, "Can't sort by "+key)
+				return
+			}
+			sort.SliceStable(tracks, func(i, j int) bool {
+				if desc {
+					return less(tracks[j], tracks[i])
+				}
+				return less(tracks[i], tracks[j])
+			})
+		}
+
+		offset, limit, err := apiPaging(q)
+		if err != nil {
+			apiError(r, 400, err.Error())
+			return
+		}
+		total := len(tracks)
+		start, end := apiBounds(total, offset, limit)
+		tracks = tracks[start:end]
+		r.JSON(200, ApiPage{Items: tracks, Total: total, Offset: offset, Limit: limit})
+	})
+
+	m.Get(apiPrefix+"/tracks/:id", func(r render.Render, params martini.Params) {
+		id, err := parseId(params["id"])
+		var track rhythmbox.Entry
+		if err == nil {
+			track, err = rb.GetTrack(id)
+		}
+		if err != nil {
+			apiLookupError(r, err)
+			return
+		}
+		r.JSON(200, apiTrack(apiAlbumIds(rb), track))
+	})
+
+	m.Get(apiPrefix+"/albums", func(r render.Render, req *http.Request) {
+		apiItems(r, req, rb.GetAlbums(), func(i rhythmbox.Item) ApiItem {
+			return apiAlbum(i)
+		})
+	})
+
+	m.Get(apiPrefix+"/albums/:id", func(r render.Render, params martini.Params) {
+		id, err := parseId(params["id"])
+		var album rhythmbox.Item
+		if err == nil {
+			album, err = rb.GetAlbum(id)
+		}
+		if err != nil {
+			apiLookupError(r, err)
+			return
+		}
+		item := apiAlbum(album)
+		item.Id = id
+		albumIds := apiAlbumIds(rb)
+		for _, e := range album.Tracks {
+			item.Tracks = append(item.Tracks, apiTrack(albumIds, e))
+		}
+		r.JSON(200, item)
+	})
+
+	m.Get(apiPrefix+"/artists", func(r render.Render, req *http.Request) {
+		apiItems(r, req, rb.GetArtists(), func(i rhythmbox.Item) ApiItem {
+			return ApiItem{Id: i.Id, Name: i.Name, Count: i.Count}
+		})
+	})
+
+	m.Get(apiPrefix+"/artists/:id", func(r render.Render, params martini.Params) {
+		id, err := parseId(params["id"])
+		var tracks rhythmbox.Item
+		var albums []rhythmbox.Item
+		if err == nil {
+			tracks, err = rb.GetArtistsTracks(id)
+		}
+		if err == nil {
+			albums, err = rb.GetArtistsAlbums(id)
+		}
+		if err != nil {
+			apiLookupError(r, err)
+			return
+		}
+		item := ApiItem{Id: id, Name: rb.Db.Entries[id].Artist, Count: len(tracks.Tracks)}
+		for _, a := range albums {
+			item.Albums = append(item.Albums, apiAlbum(a))
+		}
+		r.JSON(200, item)
+	})
+
+	m.Get(apiPrefix+"/genres", func(r render.Render, req *http.Request) {
+		apiItems(r, req, rb.GetGenres(), func(i rhythmbox.Item) ApiItem {
+			return ApiItem{Id: i.Id, Name: i.Name, Count: i.Count}
+		})
+	})
+
+	m.Get(apiPrefix+"/genres/:id", func(r render.Render, params martini.Params) {
+		id, err := parseId(params["id"])
+		var genre rhythmbox.Item
+		if err == nil {
+			genre, err = rb.GetGenreTracks(id)
+		}
+		if err != nil {
+			apiLookupError(r, err)
+			return
+		}
+		item := ApiItem{Id: id, Name: genre.Name, Count: len(genre.Tracks)}
+		albumIds := apiAlbumIds(rb)
+		for _, e := range genre.Tracks {
+			item.Tracks = append(item.Tracks, apiTrack(albumIds, e))
+		}
+		r.JSON(200, item)
+	})
+
+	m.Get(apiPrefix+"/player", func(r render.Render) {
+		r.JSON(200, rb.State())
+	})
+
+	m.Patch(apiPrefix+"/player", admin, func(r render.Render, req *http.Request) {
+		var change ApiPlayerChange
+		if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+			apiError(r, 400, "Could not read the change: "+err.Error())
+			return
+		}
+		if change.Volume != nil && (*change.Volume < 0 || *change.Volume > 1) {
+			apiError(r, 400, "Volume is from 0 to 1")
+			return
+		}
+		if change.Rating != nil && (*change.Rating < 0 || *change.Rating > 5) {
+			apiError(r, 400, "Rating is from 0 to 5")
+			return
+		}
+
+		if change.Paused != nil {
+			if *change.Paused {
+				rb.Pause()
+			} else {
+				rb.Play()
+			}
+		}
+		if change.Volume != nil {
+			rb.SetVolume(*change.Volume)
+		}
+		if change.Shuffle != nil {
+			if *change.Shuffle {
+				rb.Shuffle()
+			} else {
+				rb.NoShuffle()
+			}
+		}
+		if change.Repeat != nil {
+			if *change.Repeat {
+				rb.Repeat()
+			} else {
+				rb.NoRepeat()
+			}
+		}
+		if change.Position != nil {
+			rb.SeekTo(*change.Position)
+		}
+		if change.Rating != nil {
+			rb.SetRating(*change.Rating)
+		}
+		r.JSON(200, rb.State())
+	})
+
+	m.Post(apiPrefix+"/player/next", admin, func(r render.Render) {
+		rb.Play()
+		rb.Next()
+		r.JSON(200, rb.State())
+	})
+
+	m.Post(apiPrefix+"/player/previous", admin, func(r render.Render) {
+		rb.Previous()
+		r.JSON(200, rb.State())
+	})
+
+	m.Get(apiPrefix+"/queue", func(r render.Render) {
+		r.JSON(200, apiQueue(rb))
+	})
+
+	m.Post(apiPrefix+"/queue", dj, func(r render.Render, req *http.Request) {
+		add := ApiQueueAdd{Track: -1}
+		if err := json.NewDecoder(req.Body).Decode(&add); err != nil {
+			apiError(r, 400, "Could not read the track: "+err.Error())
+			return
+		}
+		if _, err := rb.GetTrack(add.Track); err != nil {
+			apiLookupError(r, err)
+			return
+		}
+		if add.Next {
+			rb.PlayNext(add.Track)
+		} else {
+			rb.EnqueueTrack(add.Track)
+		}
+		r.JSON(201, apiQueue(rb))
+	})
+
+	m.Delete(apiPrefix+"/queue", admin, func(r render.Render) {
+		rb.ClearQueue()
+		r.JSON(200, apiQueue(rb))
+	})
+
+	m.Patch(apiPrefix+"/queue/:position", admin, func(r render.Render, params martini.Params, req *http.Request) {
+		position, ok := apiPosition(rb, params["position"])
+		if !ok {
+			apiError(r, 404, "Nothing at that position in the queue")
+			return
+		}
+		move := ApiQueueMove{Position: -1}
+		if err := json.NewDecoder(req.Body).Decode(&move); err != nil {
+			apiError(r, 400, "Could not read the move: "+err.Error())
+			return
+		}
+		if move.Position < 0 || move.Position >= rb.QueueLength() {
+			apiError(r, 400, "Can't move there")
+			return
+		}
+		rb.MoveInQueue(position, move.Position)
+		r.JSON(200, apiQueue(rb))
+	})
+
+	m.Delete(apiPrefix+"/queue/:position", admin, func(r render.Render, params martini.Params) {
+		position, ok := apiPosition(rb, params["position"])
+		if !ok {
+			apiError(r, 404, "Nothing at that position in the queue")
+			return
+		}
+		rb.RemoveFromQueue(position)
+		r.JSON(200, apiQueue(rb))
+	})
+
+	// Anything else under the API is JSON too
+	m.Any(apiPrefix+"/**", func(r render.Render) {
+		apiError(r, 404, "No such resource")
+	})
+}
+
+// Albums, artists and genres all page, sort and filter the same way
+func apiItems(r render.Render, req *http.Request, all []rhythmbox.Item, convert func(rhythmbox.Item) ApiItem) {
+	page, err := apiItemPage(req.URL.Query(), all, convert)
+	if err != nil {
+		apiError(r, 400, err.Error())
+		return
+	}
+	r.JSON(200, page)
+}
+
+func apiItemPage(q url.Values, all []rhythmbox.Item, convert func(rhythmbox.Item) ApiItem) (ApiPage, error) {
+	items := []ApiItem{}
+	for _, i := range all {
+		if apiMatch(q, i.Entry) && apiSearch(q, i.Name) {
+			items = append(items, convert(i))
+		}
+	}
+
+	sorts := map[string]func(a, b ApiItem) bool{
+		"name":   func(a, b ApiItem) bool { return a.Name < b.Name },
+		"artist": func(a, b ApiItem) bool { return a.Artist < b.Artist },
+		"year":   func(a, b ApiItem) bool { return a.Year < b.Year },
+		"count":  func(a, b ApiItem) bool { return a.Count < b.Count },
+	}
+	key, desc := apiSort(q, "name")
+	less, ok := sorts[key]
+	if !ok {
+		return ApiPage{}, errors.New("Can't sort by " + key)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if desc {
+			return less(items[j], items[i])
+		}
+		return less(items[i], items[j])
+	})
+
+	offset, limit, err := apiPaging(q)
+	if err != nil {
+		return ApiPage{}, err
+	}
+	total := len(items)
+	start, end := apiBounds(total, offset, limit)
+	items = items[start:end]
+	return ApiPage{Items: items, Total: total, Offset: offset, Limit: limit}, nil
+}
+
+// Filters on artist, album and genre, exact but ignoring case, and a year.
+// For albums, artists and genres these are checked against their first track.
+func apiMatch(q url.Values, e rhythmbox.Entry) bool {
+	if a := q.Get("artist"); len(a) > 0 && !strings.EqualFold(a, e.Artist) {
+		return false
+	}
+	if a := q.Get("album"); len(a) > 0 && !strings.EqualFold(a, e.Album) {
+		return false
+	}
+	if g := q.Get("genre"); len(g) > 0 && !strings.EqualFold(g, e.Genre) {
+		return false
+	}
+	if y := q.Get("year"); len(y) > 0 && y != strconv.Itoa(e.Year()) {
+		return false
+	}
+	return true
+}
+
+// Whether ?q= is a bit of any of the names
+func apiSearch(q url.Values, names ...string) bool {
+	s := strings.ToLower(q.Get("q"))
+	if len(s) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if strings.Contains(strings.ToLower(n), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Works out ?sort=name, or ?sort=-name for the other way round
+func apiSort(q url.Values, def string) (key string, desc bool) {
+	key = q.Get("sort")
+	if len(key) == 0 {
+		key = def
+	}
+	if strings.HasPrefix(key, "-") {
+		return key[1:], true
+	}
+	return key, false
+}
+
+// Works out ?offset= and ?limit=
+func apiPaging(q url.Values) (offset, limit int, err error) {
+	limit = apiLimit
+	if s := q.Get("offset"); len(s) > 0 {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("Bad offset: " + s)
+		}
+	}
+	if s := q.Get("limit"); len(s) > 0 {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, fmt.Errorf("Limit should be from 1 to %d", apiMaxLimit)
+		}
+	}
+	return offset, limit, nil
+}
+
+// A queue position from the URL, if there is something there
+func apiPosition(rb *rhythmbox.Client, s string) (int, bool) {
+	position, err := strconv.Atoi(s)
+	if err != nil || position < 0 || position >= rb.QueueLength() {
+		return 0, false
+	}
+	return position, true
+}
+
+func apiTrack(albumIds map[string]int, e rhythmbox.Entry) ApiTrack {
+	albumId, ok := albumIds[e.Album]
+	if !ok {
+		albumId = -1
+	}
+
+	return ApiTrack{
+		Id:          e.Id,
+		Title:       e.Title,
+		Artist:      e.Artist,
+		Album:       e.Album,
+		AlbumId:     albumId,
+		Genre:       e.Genre,
+		TrackNumber: e.TrackNumber,
+		Year:        e.Year(),
+		Duration:    e.Duration,
+		Rating:      e.Rating,
+		PlayCount:   e.PlayCount,
+		BPM:         e.BPM,
+	}
+}
+
+func apiAlbum(i rhythmbox.Item) ApiItem {
+	item := ApiItem{
+		Id:     i.Id,
+		Name:   i.Entry.Album,
+		Artist: i.Entry.Artist,
+		Year:   i.Entry.Year(),
+		Genre:  i.Entry.Genre,
+		// Found when it is asked for, so this is a 404 for albums without art
+		Image: rhythmbox.AlbumArtURL(i.Id),
+	}
+	return item
+}
+
+// The Ids albums are listed under, by name
+func apiAlbumIds(rb *rhythmbox.Client) map[string]int {
+	albumIds := make(map[string]int)
+	for _, a := range rb.Albums {
+		albumIds[a.Name] = a.Id
+	}
+	return albumIds
+}
+
+func apiQueue(rb *rhythmbox.Client) []ApiQueueEntry {
+	albumIds := apiAlbumIds(rb)
+	queue := []ApiQueueEntry{}
+	for i, e := range rb.UpNext() {
+		queue = append(queue, ApiQueueEntry{Position: i, Track: apiTrack(albumIds, e)})
+	}
+	return queue
+}
+
+// Where a page starts and ends in total items. An offset past the end gives an
+// empty page, and is never added to, so a huge one can't overflow.
+func apiBounds(total, offset, limit int) (start, end int) {
+	if offset > total {
+		offset = total
+	}
+	if limit > total-offset {
+		limit = total - offset
+	}
+	return offset, offset + limit
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ae0000/gorhythmbox/rhythmbox"
+)
+
+func TestApiBounds(t *testing.T) {
+	const maxInt = int(^uint(0) >> 1)
+	for _, c := range []struct {
+		total, offset, limit int
+		start, end           int
+	}{
+		{10, 0, 50, 0, 10},
+		{10, 0, 5, 0, 5},
+		{10, 5, 5, 5, 10},
+		{10, 8, 5, 8, 10},
+		{10, 10, 5, 10, 10},
+		{10, 500, 5, 10, 10},
+		{10, maxInt, 5, 10, 10},
+		{10, 5, maxInt, 5, 10},
+		{0, 0, 50, 0, 0},
+	} {
+		start, end := apiBounds(c.total, c.offset, c.limit)
+		if start != c.start || end != c.end {
+			t.Errorf("apiBounds(%v, %v, %v) = %v, %v, want %v, %v",
+				c.total, c.offset, c.limit, start, end, c.start, c.end)
+		}
+	}
+}
+
+func TestApiPaging(t *testing.T) {
+	for query, want := range map[string]string{
+		"":                   "0 50 <nil>",
+		"offset=20&limit=10": "20 10 <nil>",
+		"limit=500":          "0 500 <nil>",
+		"limit=501":          "0 0 Limit should be from 1 to 500",
+		"limit=0":            "0 0 Limit should be from 1 to 500",
+		"offset=-1":          "0 0 Bad offset: -1",
+		"offset=ten":         "0 0 Bad offset: ten",
+	} {
+		q, _ := url.ParseQuery(query)
+		offset, limit, err := apiPaging(q)
+		if got := fmt.Sprint(offset, limit, err); got != want {
+			t.Errorf("%q gave %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestApiItemPage(t *testing.T) {
+	var all []rhythmbox.Item
+	for i, name := range []string{"Cee", "Ay", "Bee"} {
+		all = append(all, rhythmbox.Item{Id: i, Name: name, Count: i})
+	}
+	convert := func(i rhythmbox.Item) ApiItem {
+		return ApiItem{Id: i.Id, Name: i.Name, Count: i.Count}
+	}
+	page := func(query string) string {
+		q, _ := url.ParseQuery(query)
+		p, err := apiItemPage(q, all, convert)
+		if err != nil {
+			return err.Error()
+		}
+		data, _ := json.Marshal(p)
+		return string(data)
+	}
+
+	for query, want := range map[string]string{
+		"":                   `"items":[{"id":1,"name":"Ay","count":1},{"id":2,"name":"Bee","count":2},{"id":0,"name":"Cee"}],"total":3,"offset":0,"limit":50`,
+		"sort=-name&limit=1": `"items":[{"id":0,"name":"Cee"}],"total":3,"offset":0,"limit":1`,
+		"offset=2":           `"items":[{"id":0,"name":"Cee"}],"total":3,"offset":2,"limit":50`,
+		"offset=3":           `"items":[],"total":3,"offset":3,"limit":50`,
+		"offset=99999":       `"items":[],"total":3,"offset":99999,"limit":50`,
+		"q=nothing":          `"items":[],"total":0,"offset":0,"limit":50`,
+		"sort=colour":        `Can't sort by colour`,
+		"limit=-1":           `Limit should be from 1 to 500`,
+	} {
+		if got := page(query); !strings.Contains(got, want) {
+			t.Errorf("%q gave %v, want %v", query, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/codegangsta/martini"
+)
+
+// The templates and the public css, fonts and js are built in, so the binary
+// can be run from anywhere. Only those dirs, so nothing left lying around in
+// public is built in with them.
+//
+//go:embed templates public/css public/fonts public/js
+var embedded embed.FS
+
+// Files in the override dir win over the built in ones, so the look can be
+// changed without a rebuild. It is laid out the same, templates/ and public/.
+type assets struct {
+	dir string
+}
+
+func (a assets) Open(name string) (fs.File, error) {
+	if len(a.dir) > 0 {
+		f, err := os.DirFS(a.dir).Open(name)
+		if err == nil {
+			return f, nil
+		}
+	}
+	return embedded.Open(name)
+}
+
+// Everything matching the pattern, from both places
+func (a assets) glob(pattern string) ([]string, error) {
+	names, err := fs.Glob(embedded, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.dir) > 0 {
+		more, err := fs.Glob(os.DirFS(a.dir), pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range more {
+			i := sort.SearchStrings(names, name)
+			if i == len(names) || names[i] != name {
+				names = append(names[:i], append([]string{name}, names[i:]...)...)
+			}
+		}
+	}
+	return names, nil
+}
+
+// render only reads templates off the disk, so give it a dir of them. Each set
+// of templates gets its own dir under base, named by what is in them, so
+// other instances using the same base are never changed under them. Returns
+// the dir.
+func (a assets) writeTemplates(base string) (string, error) {
+	names, err := a.glob("templates/*.html")
+	if err != nil {
+		return "", err
+	}
+	templates := make(map[string][]byte)
+	hash := sha256.New()
+	for _, name := range names {
+		data, err := fs.ReadFile(a, name)
+		if err != nil {
+			return "", err
+		}
+		templates[name] = data
+		fmt.Fprintf(hash, "%s %d\n", name, len(data))
+		hash.Write(data)
+	}
+	dir := filepath.Join(base, hex.EncodeToString(hash.Sum(nil))[:16])
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	// Written to the side and moved into place, so it is there whole or not
+	// at all
+	err = os.MkdirAll(base, 0755)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(base, ".new-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	for name, data := range templates {
+		err = ioutil.WriteFile(filepath.Join(tmp, path.Base(name)), data, 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = os.Rename(tmp, dir)
+	if _, statErr := os.Stat(dir); err != nil && statErr == nil {
+		// Another instance got there first, with the same templates
+		err = nil
+	}
+	return dir, err
+}
+
+// Martini middleware, serves anything in public and lets everything else
+// through to the routes
+func (a assets) serve(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return
+	}
+
+	f, err := a.Open("public" + path.Clean("/"+req.URL.Path))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return
+	}
+	http.ServeContent(w, req, info.Name(), info.ModTime(), content)
+}
+
+// Like martini.Classic, but with the files served from assets
+func newMartini(a assets) *martini.ClassicMartini {
+	r := martini.NewRouter()
+	m := martini.New()
+	m.Use(martini.Logger())
+	m.Use(martini.Recovery())
+	m.Use(a.serve)
+	m.MapTo(r, (*martini.Routes)(nil))
+	m.Action(r.Handle)
+	return &martini.ClassicMartini{Martini: m, Router: r}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// What people are allowed to do, each can do everything the ones before can
+const (
+	RoleListener = "listener" // Browse only
+	RoleDJ       = "dj"       // Guest DJ, may add to the queue
+	RoleAdmin    = "admin"    // Full control
+)
+
+var roleRank = map[string]int{RoleListener: 1, RoleDJ: 2, RoleAdmin: 3}
+
+// Logins are kept in the data dir. Until there is somebody in it anyone can do
+// anything, like before.
+const usersFile = "users.json"
+
+// How long a login lasts
+const sessionLength = 30 * 24 * time.Hour
+
+const sessionCookie = "session"
+
+// Checked against when there is no such user
+var noUserHash, _ = bcrypt.GenerateFromPassword([]byte("nobody"), bcrypt.DefaultCost)
+
+/*
+[
+  {"Name": "ae", "Password": "$2a$10$...", "Role": "admin", "Tokens": ["<sha256 of a token>"]}
+]
+*/
+
+type User struct {
+	Name     string
+	Password string   // bcrypt
+	Role     string   // RoleListener, RoleDJ or RoleAdmin
+	Tokens   []string // sha256 of each API token, we never keep the tokens
+}
+
+func (u User) Can(role string) bool {
+	return roleRank[u.Role] >= roleRank[role]
+}
+
+type session struct {
+	user    string
+	expires time.Time
+}
+
+type Users struct {
+	mu       sync.Mutex
+	path     string
+	users    []User
+	sessions map[string]session
+	secure   bool // Serving over TLS, so the cookie is only sent over https
+}
+
+// Read in the users, it is fine if there are none
+func loadUsers(dataDir string) *Users {
+	u := &Users{path: filepath.Join(dataDir, usersFile), sessions: make(map[string]session)}
+
+	var err error
+	u.users, err = readUsers(u.path)
+	if err != nil {
+		// Better to stop than leave the speakers open to everyone
+		fmt.Printf("[ERRO] Could not load users: %v\n", err)
+		os.Exit(1)
+	}
+	return u
+}
+
+func readUsers(path string) ([]User, error) {
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	err = json.Unmarshal(file, &users)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if roleRank[user.Role] == 0 {
+			return nil, fmt.Errorf("%v has an unknown role: %v", user.Name, user.Role)
+		}
+	}
+	return users, nil
+}
+
+// Read the users file again, after "gorhythmbox user" or "gorhythmbox token"
+// changed it. If it can't be read the users we have are kept. Sessions are
+// kept too, anyone who is gone or whose role changed is looked up by name on
+// their next request.
+func (u *Users) reload() error {
+	users, err := readUsers(u.path)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.users = users
+	u.mu.Unlock()
+	return nil
+}
+
+// Call with the lock held
+func (u *Users) save() error {
+	data, err := json.MarshalIndent(u.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(u.path), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(u.path, data, 0600)
+}
+
+func (u *Users) Enabled() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.users) > 0
+}
+
+// The user with the name and password, if there is one
+func (u *Users) Login(name, password string) (User, bool) {
+	u.mu.Lock()
+	user, ok := u.byName(name)
+	u.mu.Unlock()
+
+	if !ok {
+		// Take as long as a real check, so names can't be guessed by timing
+		bcrypt.CompareHashAndPassword(noUserHash, []byte(password))
+		return User{}, false
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	return user, err == nil
+}
+
+// Call with the lock held
+func (u *Users) byName(name string) (User, bool) {
+	for _, user := range u.users {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Who the request is from, by their session cookie or bearer token
+func (u *Users) identify(req *http.Request) (User, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		hash := hex.EncodeToString(sum[:])
+		for _, user := range u.users {
+			for _, t := range user.Tokens {
+				if subtle.ConstantTimeCompare([]byte(t), []byte(hash)) == 1 {
+					return user, true
+				}
+			}
+		}
+		return User{}, false
+	}
+
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return User{}, false
+	}
+	s, ok := u.sessions[cookie.Value]
+	if !ok || time.Now().After(s.expires) {
+		delete(u.sessions, cookie.Value)
+		return User{}, false
+	}
+	return u.byName(s.user)
+}
+
+func (u *Users) startSession(w http.ResponseWriter, user User) {
+	id := newCsrfToken()
+	expires := time.Now().Add(sessionLength)
+
+	u.mu.Lock()
+	u.sessions[id] = session{user: user.Name, expires: expires}
+	u.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   u.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (u *Users) endSession(w http.ResponseWriter, req *http.Request) {
+	if cookie, err := req.Cookie(sessionCookie); err == nil {
+		u.mu.Lock()
+		delete(u.sessions, cookie.Value)
+		u.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, Secure: u.secure})
+}
+
+// Martini middleware, works out who is asking and sends anybody who isn't
+// logged in to do so. The User is mapped for handlers that want it.
+func (u *Users) check(c martini.Context, w http.ResponseWriter, req *http.Request) {
+	if !u.Enabled() {
+		c.Map(User{Name: "", Role: RoleAdmin})
+		return
+	}
+
+	user, ok := u.identify(req)
+	if ok {
+		c.Map(user)
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/login":
+		c.Map(User{})
+	case strings.HasPrefix(req.URL.Path, apiPrefix+"/"):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		authError(w, req, http.StatusUnauthorized, "Log in or send a bearer token")
+	case req.Method == "GET" && !strings.HasPrefix(req.URL.Path, "/ajax/") && req.URL.Path != "/events":
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	default:
+		authError(w, req, http.StatusUnauthorized, "Log in first")
+	}
+}
+
+// A handler for routes only some roles may use, put it before the route's own
+func needs(role string) martini.Handler {
+	return func(user User, w http.ResponseWriter, req *http.Request) {
+		if !user.Can(role) {
+			authError(w, req, http.StatusForbidden, "You need to be "+role+" to do that")
+		}
+	}
+}
+
+func authError(w http.ResponseWriter, req *http.Request, status int, message string) {
+	if strings.HasPrefix(req.URL.Path, apiPrefix+"/") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ApiError{ApiErrorBody{Status: status, Message: message}})
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func authRoutes(m *martini.ClassicMartini, u *Users) {
+	m.Get("/login", func(r render.Render) {
+		r.HTML(200, "login", PageData{Name: "Log in"})
+	})
+
+	m.Post("/login", func(r render.Render, w http.ResponseWriter, req *http.Request) {
+		user, ok := u.Login(req.PostFormValue("name"), req.PostFormValue("password"))
+		if !ok {
+			r.HTML(401, "login", PageData{Name: "Log in", Error: "Wrong name or password"})
+			return
+		}
+		u.startSession(w, user)
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+	})
+
+	m.Post("/logout", func(w http.ResponseWriter, req *http.Request) {
+		u.endSession(w, req)
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	})
+
+	// Who is logged in, for the page to show and hide things. The name is
+	// empty when logins are off.
+	m.Get("/ajax/me", func(r render.Render, user User) {
+		r.JSON(200, AjaxReturn{A: user.Name, B: user.Role})
+	})
+
+	// Picks up users and tokens added since we started. This is all there is to
+	// reload: the library is read once in Setup and shared by every request
+	// without locks, so changing it needs a restart, and so does the config.
+	m.Post("/settings/reload", needs(RoleAdmin), func(w http.ResponseWriter, req *http.Request) {
+		if err := u.reload(); err != nil {
+			fmt.Printf("[ERRO] Could not reload users: %v\n", err)
+			http.Error(w, "Could not reload users: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		seeOther(w, req, "/", nil)
+	})
+}
+
+// Handles "gorhythmbox user <name> <role>", which reads a password from stdin,
+// and "gorhythmbox token <name>", which prints a new API token
+func usersCommand(dataDir string, args []string) error {
+	u := loadUsers(dataDir)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	switch {
+	case len(args) == 3 && args[0] == "user":
+		if roleRank[args[2]] == 0 {
+			return errors.New("Role should be listener, dj or admin")
+		}
+		fmt.Print("Password: ")
+		// Without echoing it back
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+		password := string(b)
+		if len(password) == 0 {
+			return errors.New("No password")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+
+		user := User{Name: args[1], Password: string(hash), Role: args[2]}
+		for i, o := range u.users {
+			if o.Name == user.Name {
+				user.Tokens = o.Tokens
+				u.users = append(u.users[:i], u.users[i+1:]...)
+				break
+			}
+		}
+		u.users = append(u.users, user)
+		return u.save()
+
+	case len(args) == 2 && args[0] == "token":
+		for i, user := range u.users {
+			if user.Name == args[1] {
+				b := make([]byte, 32)
+				if _, err := rand.Read(b); err != nil {
+					return err
+				}
+				token := hex.EncodeToString(b)
+				sum := sha256.Sum256([]byte(token))
+				u.users[i].Tokens = append(user.Tokens, hex.EncodeToString(sum[:]))
+				if err := u.save(); err != nil {
+					return err
+				}
+				fmt.Println(token)
+				return nil
+			}
+		}
+		return errors.New("No such user: " + args[1])
+	}
+
+	return errors.New("Usage: gorhythmbox user <name> <listener|dj|admin>, or gorhythmbox token <name>")
+}
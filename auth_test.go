@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionCookieSecure(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		u := loadUsers(t.TempDir())
+		u.secure = secure
+
+		w := httptest.NewRecorder()
+		u.startSession(w, User{Name: "ae", Role: RoleAdmin})
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Got %v cookies, want 1", len(cookies))
+		}
+		if cookies[0].Secure != secure {
+			t.Errorf("With TLS %v the cookie's Secure is %v", secure, cookies[0].Secure)
+		}
+	}
+}
+
+func TestUsersReload(t *testing.T) {
+	dir := t.TempDir()
+	u := loadUsers(dir)
+	if u.Enabled() {
+		t.Fatal("Logins are on with no users file")
+	}
+
+	write := func(data string) {
+		err := ioutil.WriteFile(filepath.Join(dir, usersFile), []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`[{"Name": "ae", "Role": "dj"}]`)
+	if err := u.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.byName("ae"); !ok {
+		t.Error("ae wasn't picked up")
+	}
+
+	// A broken file keeps who we had
+	write(`[{"Name": "ae", "Role": "boss"}]`)
+	if err := u.reload(); err == nil {
+		t.Error("No error for an unknown role")
+	}
+	if user, ok := u.byName("ae"); !ok || user.Role != RoleDJ {
+		t.Errorf("Got %+v after a bad reload, want ae still a dj", user)
+	}
+
+	if err := os.Remove(filepath.Join(dir, usersFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if u.Enabled() {
+		t.Error("Logins are still on after the users file went")
+	}
+}
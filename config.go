@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ae0000/gorhythmbox/rhythmbox"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+)
+
+/*
+# ~/.config/gorhythmbox/config.toml, everything is optional
+library = "/home/ae/.local/share/rhythmbox/rhythmdb.xml"
+data_dir = "/home/ae/.local/share/gorhythmbox"
+client = "/usr/bin/rhythmbox-client"
+listen = ":3000"
+tls_cert = "/etc/ssl/music.pem"
+tls_key = "/etc/ssl/music.key"
+cache_dir = "/home/ae/.cache/gorhythmbox"
+art_dir = "/home/ae/.cache/gorhythmbox/art"
+art_patterns = ["cover.*", "folder.*", "front.*", "albumart*"]
+art_ignore = ["back*", "*inlay*", "*tray*", "cd*", "disc*", "*booklet*"]
+assets = "/home/ae/gorhythmbox-theme"
+
+[smart_shuffle]
+rating = 2
+under_played = 1
+artist_gap = 3
+album_gap = 5
+recent = "24h"
+recent_penalty = 0.1
+
+[features]
+api = true
+alarms = true
+scrobbling = true
+*/
+
+type Config struct {
+	Library     string   `toml:"library"`
+	DataDir     string   `toml:"data_dir"`
+	Client      string   `toml:"client"`
+	Listen      string   `toml:"listen"`
+	TLSCert     string   `toml:"tls_cert"`
+	TLSKey      string   `toml:"tls_key"`
+	CacheDir    string   `toml:"cache_dir"` // For the templates, and art unless art_dir is set
+	ArtDir      string   `toml:"art_dir"`
+	ArtPatterns []string `toml:"art_patterns"` // Cover file names, best first
+	ArtIgnore   []string `toml:"art_ignore"`   // Images that are never the cover
+	Assets      string   `toml:"assets"`       // Overrides for the built in templates/ and public/
+	Features    Features `toml:"features"`
+
+	SmartShuffle rhythmbox.SmartWeights `toml:"smart_shuffle"`
+}
+
+// Parts that can be turned off, they are all on unless the config says not
+type Features struct {
+	API        bool `toml:"api"`
+	Alarms     bool `toml:"alarms"`
+	Scrobbling bool `toml:"scrobbling"`
+}
+
+// For the templates, {{if feature "alarms"}}
+func (f Features) On(name string) bool {
+	switch name {
+	case "api":
+		return f.API
+	case "alarms":
+		return f.Alarms
+	case "scrobbling":
+		return f.Scrobbling
+	}
+	return false
+}
+
+// A handler for routes that belong to a feature, put it before the route's own
+func feature(on bool) martini.Handler {
+	return func(r render.Render, req *http.Request) {
+		if !on {
+			r.HTML(404, "error", PageData{Name: "Not found", Error: "Nothing at " + req.URL.Path})
+		}
+	}
+}
+
+// Each setting can also come from the environment, which beats the file
+var configEnv = map[string]string{
+	"library":   "GORHYTHMBOX_LIBRARY",
+	"data_dir":  "GORHYTHMBOX_DATA_DIR",
+	"client":    "GORHYTHMBOX_CLIENT",
+	"listen":    "GORHYTHMBOX_LISTEN",
+	"tls_cert":  "GORHYTHMBOX_TLS_CERT",
+	"tls_key":   "GORHYTHMBOX_TLS_KEY",
+	"cache_dir": "GORHYTHMBOX_CACHE_DIR",
+	"art_dir":   "GORHYTHMBOX_ART_DIR",
+	"assets":    "GORHYTHMBOX_ASSETS",
+}
+
+func defaultConfig() Config {
+	return Config{
+		Library:     filepath.Join(rhythmbox.DataHome(), rhythmbox.RhythmboxXmlLibrary),
+		DataDir:     filepath.Join(rhythmbox.DataHome(), rhythmbox.GorhythmboxDataDir),
+		Client:      rhythmbox.RhythmboxClient,
+		Listen:      ":3000",
+		CacheDir:    filepath.Join(rhythmbox.CacheHome(), rhythmbox.GorhythmboxCacheDir),
+		ArtPatterns: append([]string{}, rhythmbox.DefaultArtPatterns...),
+		ArtIgnore:   append([]string{}, rhythmbox.DefaultArtIgnore...),
+		Features:    Features{API: true, Alarms: true, Scrobbling: true},
+
+		SmartShuffle: rhythmbox.DefaultSmartWeights,
+	}
+}
+
+// $XDG_CONFIG_HOME/gorhythmbox/config.toml, or in .config if that isn't set
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if !filepath.IsAbs(dir) {
+		usr, err := user.Current()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(usr.HomeDir, ".config")
+	}
+	return filepath.Join(dir, "gorhythmbox", "config.toml")
+}
+
+// Work out the config from the defaults, then the file, then the environment,
+// then the flags. Whatever is left over in args is returned, for the user
+// and token commands.
+func loadConfig(args []string) (Config, []string, error) {
+	c := defaultConfig()
+
+	flags := flag.NewFlagSet("gorhythmbox", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("GORHYTHMBOX_CONFIG"), "Config file (default "+defaultConfigPath()+")")
+	library := flags.String("library", "", "Rhythmbox's rhythmdb.xml")
+	dataDir := flags.String("data-dir", "", "Where to keep schedules, history and logins")
+	client := flags.String("client", "", "The rhythmbox-client to run")
+	listen := flags.String("listen", "", "Address to listen on, like :3000")
+	tlsCert := flags.String("tls-cert", "", "Certificate to serve HTTPS with")
+	tlsKey := flags.String("tls-key", "", "Key for the certificate")
+	cacheDir := flags.String("cache-dir", "", "Where to keep things that can be thrown away")
+	artDir := flags.String("art-dir", "", "Where to keep album art (default art in the cache dir)")
+	assets := flags.String("assets", "", "Dir of templates/ and public/ files to use instead of the built in ones")
+	err := flags.Parse(args)
+	if err != nil {
+		return c, nil, err
+	}
+
+	// It is fine to have no config file, unless one was asked for
+	file := *path
+	if len(file) == 0 {
+		file = defaultConfigPath()
+	}
+	md, err := toml.DecodeFile(file, &c)
+	switch {
+	case os.IsNotExist(err) && len(*path) == 0:
+	case err != nil:
+		return c, nil, fmt.Errorf("Could not read %v: %v", file, err)
+	default:
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return c, nil, fmt.Errorf("Unknown setting in %v: %v", file, undecoded[0])
+		}
+	}
+
+	settings := map[string][2]*string{
+		"library":   {&c.Library, library},
+		"data_dir":  {&c.DataDir, dataDir},
+		"client":    {&c.Client, client},
+		"listen":    {&c.Listen, listen},
+		"tls_cert":  {&c.TLSCert, tlsCert},
+		"tls_key":   {&c.TLSKey, tlsKey},
+		"cache_dir": {&c.CacheDir, cacheDir},
+		"art_dir":   {&c.ArtDir, artDir},
+		"assets":    {&c.Assets, assets},
+	}
+	for name, s := range settings {
+		if v := os.Getenv(configEnv[name]); len(v) > 0 {
+			*s[0] = v
+		}
+		if len(*s[1]) > 0 {
+			*s[0] = *s[1]
+		}
+	}
+
+	// Art follows the cache dir, unless it was given a place of its own
+	if len(c.ArtDir) == 0 {
+		c.ArtDir = filepath.Join(c.CacheDir, "art")
+	}
+
+	return c, flags.Args(), nil
+}
+
+// Everything we need to serve, checked before we start so mistakes show up
+// straight away rather than on the first request
+func (c Config) validate() error {
+	var problems []string
+
+	if _, err := os.Stat(c.Library); err != nil {
+		problems = append(problems, fmt.Sprintf("library: %v", err))
+	}
+	if _, err := exec.LookPath(c.Client); err != nil {
+		problems = append(problems, fmt.Sprintf("client: %v", err))
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen: %v", err))
+	}
+	if (len(c.TLSCert) == 0) != (len(c.TLSKey) == 0) {
+		problems = append(problems, "tls_cert and tls_key go together")
+	}
+	for _, f := range []string{c.TLSCert, c.TLSKey} {
+		if len(f) == 0 {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			problems = append(problems, fmt.Sprintf("tls: %v", err))
+		}
+	}
+	for _, p := range append(append([]string{}, c.ArtPatterns...), c.ArtIgnore...) {
+		if _, err := filepath.Match(p, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("art pattern %q: %v", p, err))
+		}
+	}
+	if err := c.SmartShuffle.Validate(); err != nil {
+		problems = append(problems, "smart_shuffle: "+err.Error())
+	}
+	if len(c.Assets) > 0 {
+		if info, err := os.Stat(c.Assets); err != nil {
+			problems = append(problems, fmt.Sprintf("assets: %v", err))
+		} else if !info.IsDir() {
+			problems = append(problems, "assets: "+c.Assets+" is not a dir")
+		}
+	}
+	for _, dir := range []string{c.DataDir, c.CacheDir, c.ArtDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Bad config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Hand the settings on to the client
+func (c Config) apply(rb *rhythmbox.Client) {
+	rb.Library = c.Library
+	rb.DataDir = c.DataDir
+	rb.ClientBinary = c.Client
+	rb.ArtDir = c.ArtDir
+	rb.ArtPatterns = c.ArtPatterns
+	rb.ArtIgnore = c.ArtIgnore
+	rb.SmartWeights = c.SmartShuffle
+	rb.DisableScrobbling = !c.Features.Scrobbling
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ae0000/gorhythmbox/rhythmbox"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+)
+
+// Somewhere to look for config.toml with nothing from the environment, the
+// file is only written when there is something for it
+func configHome(t *testing.T, file string) string {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("GORHYTHMBOX_CONFIG", "")
+	for _, name := range configEnv {
+		t.Setenv(name, "")
+	}
+	path := filepath.Join(dir, "gorhythmbox", "config.toml")
+	if len(file) > 0 {
+		writeFile(t, path, file)
+	}
+	return path
+}
+
+func writeFile(t *testing.T, path, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string
+		flag string
+		want string
+	}{
+		{"defaults", "", "", "", ":3000"},
+		{"file beats defaults", ":4000", "", "", ":4000"},
+		{"env beats file", ":4000", ":5000", "", ":5000"},
+		{"flag beats env", ":4000", ":5000", ":6000", ":6000"},
+		{"flag beats file", ":4000", "", ":6000", ":6000"},
+		{"env beats defaults", "", ":5000", "", ":5000"},
+	}
+
+	for _, tt := range tests {
+		file := ""
+		if len(tt.file) > 0 {
+			file = `listen = "` + tt.file + `"` + "\n"
+		}
+		configHome(t, file)
+		t.Setenv("GORHYTHMBOX_LISTEN", tt.env)
+		var args []string
+		if len(tt.flag) > 0 {
+			args = []string{"-listen", tt.flag}
+		}
+
+		c, _, err := loadConfig(args)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if c.Listen != tt.want {
+			t.Errorf("%v: listening on %q, want %q", tt.name, c.Listen, tt.want)
+		}
+	}
+}
+
+// Only what is set is changed, whichever way it is set
+func TestConfigPartial(t *testing.T) {
+	configHome(t, "client = \"/file/client\"\n[features]\nalarms = false\n")
+	t.Setenv("GORHYTHMBOX_DATA_DIR", "/env/data")
+
+	c, args, err := loadConfig([]string{"-art-dir", "/flag/art", "user", "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := defaultConfig()
+	if c.Client != "/file/client" || c.DataDir != "/env/data" || c.ArtDir != "/flag/art" {
+		t.Errorf("Got client %q, data %q and art %q", c.Client, c.DataDir, c.ArtDir)
+	}
+	if c.Library != d.Library || c.Listen != d.Listen {
+		t.Errorf("Got library %q and listen %q, want the defaults", c.Library, c.Listen)
+	}
+	if want := (Features{API: true, Scrobbling: true}); c.Features != want {
+		t.Errorf("Got %+v, want only alarms off", c.Features)
+	}
+	if strings.Join(args, " ") != "user list" {
+		t.Errorf("Left %v, want the user command", args)
+	}
+}
+
+// Art goes in the cache dir, wherever that is, unless it has a dir of its own
+func TestConfigCacheDir(t *testing.T) {
+	tests := []struct {
+		file string
+		args []string
+		art  string
+	}{
+		{"", nil, filepath.Join(defaultConfig().CacheDir, "art")},
+		{"cache_dir = \"/file/cache\"\n", nil, "/file/cache/art"},
+		{"", []string{"-cache-dir", "/flag/cache"}, "/flag/cache/art"},
+		{"cache_dir = \"/file/cache\"\nart_dir = \"/file/art\"\n", nil, "/file/art"},
+		{"art_dir = \"/file/art\"\n", []string{"-cache-dir", "/flag/cache"}, "/file/art"},
+	}
+
+	for _, tt := range tests {
+		configHome(t, tt.file)
+		c, _, err := loadConfig(tt.args)
+		if err != nil {
+			t.Errorf("%q %v: %v", tt.file, tt.args, err)
+			continue
+		}
+		if c.ArtDir != tt.art {
+			t.Errorf("%q %v: art in %q, want %q", tt.file, tt.args, c.ArtDir, tt.art)
+		}
+	}
+}
+
+// A config file that was asked for has to be there
+func TestConfigMissing(t *testing.T) {
+	configHome(t, "")
+	if _, _, err := loadConfig(nil); err != nil {
+		t.Errorf("No config file in the usual place: %v", err)
+	}
+	if _, _, err := loadConfig([]string{"-config", filepath.Join(t.TempDir(), "nope.toml")}); err == nil {
+		t.Error("No error for a config file that isn't there")
+	}
+}
+
+// Everything a good config needs, in temp dirs
+func validConfig(t *testing.T) Config {
+	dir := t.TempDir()
+	c := defaultConfig()
+	c.Library = filepath.Join(dir, "rhythmdb.xml")
+	writeFile(t, c.Library, "<rhythmdb/>\n")
+	c.DataDir = filepath.Join(dir, "data")
+	c.CacheDir = filepath.Join(dir, "cache")
+	c.ArtDir = filepath.Join(dir, "art")
+	c.Client = "true"
+	return c
+}
+
+func TestConfigRejected(t *testing.T) {
+	if err := validConfig(t).validate(); err != nil {
+		t.Fatalf("A good config: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"no library", func(c *Config) { c.Library = filepath.Join(t.TempDir(), "nope.xml") }, "library"},
+		{"no client", func(c *Config) { c.Client = "no-such-rhythmbox-client" }, "client"},
+		{"bad listen", func(c *Config) { c.Listen = "3000" }, "listen"},
+		{"cert without key", func(c *Config) { c.TLSCert = c.Library }, "tls_cert and tls_key"},
+		{"missing key", func(c *Config) { c.TLSCert, c.TLSKey = c.Library, "/no/such.key" }, "tls"},
+		{"bad art pattern", func(c *Config) { c.ArtPatterns = []string{"cover[.jpg"} }, "art pattern"},
+		{"bad smart shuffle", func(c *Config) { c.SmartShuffle.Rating = -1 }, "smart_shuffle"},
+		{"assets not a dir", func(c *Config) { c.Assets = c.Library }, "assets"},
+	}
+
+	for _, tt := range tests {
+		c := validConfig(t)
+		tt.change(&c)
+		err := c.validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want a problem with %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// Mistakes in the file stop it loading
+func TestConfigBadFile(t *testing.T) {
+	tests := []string{
+		"listen = 3000\n",
+		"lsiten = \":3000\"\n",
+		"[features]\napi = \"yes\"\n",
+		"[features]\nradio = false\n",
+		"listen = \":3000\n",
+	}
+
+	for _, file := range tests {
+		configHome(t, file)
+		if _, _, err := loadConfig(nil); err == nil {
+			t.Errorf("%q loaded", file)
+		}
+	}
+	configHome(t, "")
+	if _, _, err := loadConfig([]string{"-no-such-flag"}); err == nil {
+		t.Error("An unknown flag was taken")
+	}
+}
+
+// Keeps the routes instead of serving them
+type routeRecorder struct {
+	martini.Router
+	routes map[string][]martini.Handler
+}
+
+func (rr *routeRecorder) Get(path string, h ...martini.Handler) martini.Route {
+	rr.routes["GET "+path] = h
+	return nil
+}
+
+func (rr *routeRecorder) Post(path string, h ...martini.Handler) martini.Route {
+	rr.routes["POST "+path] = h
+	return nil
+}
+
+func (rr *routeRecorder) Patch(path string, h ...martini.Handler) martini.Route {
+	rr.routes["PATCH "+path] = h
+	return nil
+}
+
+func (rr *routeRecorder) Put(path string, h ...martini.Handler) martini.Route {
+	rr.routes["PUT "+path] = h
+	return nil
+}
+
+func (rr *routeRecorder) Delete(path string, h ...martini.Handler) martini.Route {
+	rr.routes["DELETE "+path] = h
+	return nil
+}
+
+func (rr *routeRecorder) Any(path string, h ...martini.Handler) martini.Route {
+	rr.routes["ANY "+path] = h
+	return nil
+}
+
+func (rr *routeRecorder) NotFound(h ...martini.Handler) {}
+
+// Remembers the status of the page rendered
+type statusRender struct {
+	render.Render
+	status int
+}
+
+func (sr *statusRender) HTML(status int, name string, v interface{}, htmlOpt ...render.HTMLOptions) {
+	sr.status = status
+}
+
+func TestFeatures(t *testing.T) {
+	rb := testLibrary(t)
+	all := Features{API: true, Alarms: true, Scrobbling: true}
+	tests := []struct {
+		name     string
+		features Features
+		api      bool
+		alarms   bool
+		jobs     []string
+	}{
+		{"all on", all, true, true, []string{"alarms", "scrobbler", "watch"}},
+		{"api off", Features{Alarms: true, Scrobbling: true}, false, true, []string{"alarms", "scrobbler", "watch"}},
+		{"alarms off", Features{API: true, Scrobbling: true}, true, false, []string{"scrobbler", "watch"}},
+		{"scrobbling off", Features{API: true, Alarms: true}, true, true, []string{"alarms", "watch"}},
+		{"all off", Features{}, false, false, []string{"watch"}},
+	}
+
+	for _, tt := range tests {
+		rr := &routeRecorder{routes: make(map[string][]martini.Handler)}
+		routes(&martini.ClassicMartini{Martini: martini.New(), Router: rr}, rb, &Users{}, tt.features)
+
+		api := false
+		for route := range rr.routes {
+			if strings.Contains(route, " "+apiPrefix+"/") {
+				api = true
+			}
+		}
+		if api != tt.api {
+			t.Errorf("%v: API routes %v, want %v", tt.name, api, tt.api)
+		}
+
+		// Alarm routes stay, and say there is nothing there when off
+		for _, route := range []string{"GET /alarms", "POST /alarms/save", "POST /alarms/run/:id"} {
+			handlers := rr.routes[route]
+			if len(handlers) == 0 {
+				t.Fatalf("%v: no %v", tt.name, route)
+			}
+			check, ok := handlers[0].(func(render.Render, *http.Request))
+			if !ok {
+				t.Fatalf("%v: %v doesn't start with the feature check", tt.name, route)
+			}
+			sr := &statusRender{}
+			check(sr, httptest.NewRequest("GET", "/alarms", nil))
+			if off := sr.status == 404; off == tt.alarms {
+				t.Errorf("%v: %v gave %v with alarms %v", tt.name, route, sr.status, tt.alarms)
+			}
+		}
+
+		var jobs []string
+		for name := range background(rb, tt.features) {
+			jobs = append(jobs, name)
+		}
+		sort.Strings(jobs)
+		if strings.Join(jobs, " ") != strings.Join(tt.jobs, " ") {
+			t.Errorf("%v: running %v, want %v", tt.name, jobs, tt.jobs)
+		}
+
+		var applied rhythmbox.Client
+		c := defaultConfig()
+		c.Features = tt.features
+		c.apply(&applied)
+		if applied.DisableScrobbling == tt.features.Scrobbling {
+			t.Errorf("%v: DisableScrobbling is %v", tt.name, applied.DisableScrobbling)
+		}
+	}
+}
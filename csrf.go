@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Each browser gets a random token in a cookie, and has to send it back with
+// every POST, as a form field or a header. Other sites can make a browser POST
+// to us, but they can't read our cookie to get the token.
+const (
+	csrfCookie = "csrf"
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Martini middleware, stops any request that changes something and doesn't
+// carry the token
+func csrf(w http.ResponseWriter, req *http.Request) {
+	token := ""
+	if cookie, err := req.Cookie(csrfCookie); err == nil {
+		token = cookie.Value
+	}
+	if len(token) == 0 {
+		token = newCsrfToken()
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    token,
+			Path:     "/",
+			Secure:   req.TLS != nil, // Like the session cookie
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+
+	// Browsers never send a bearer token by themselves, so a request with one
+	// can't have been forged
+	if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return
+	}
+
+	// API clients aren't browsers and don't have the cookie. Other sites can't
+	// send JSON without us agreeing to it first, so insist on that instead.
+	if strings.HasPrefix(req.URL.Path, apiPrefix+"/") {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			json.NewEncoder(w).Encode(ApiError{ApiErrorBody{
+				Status:  http.StatusUnsupportedMediaType,
+				Message: "Send application/json",
+			}})
+		}
+		return
+	}
+
+	sent := req.Header.Get(csrfHeader)
+	if len(sent) == 0 {
+		sent = req.PostFormValue(csrfField)
+	}
+	if len(sent) == 0 || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		http.Error(w, "Missing or wrong CSRF token, try reloading the page", http.StatusForbidden)
+	}
+}
+
+func newCsrfToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
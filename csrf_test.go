@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCsrfCookieSecure(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		csrf(w, req)
+
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != csrfCookie {
+			t.Fatalf("Got cookies %v, want the csrf one", cookies)
+		}
+		if cookies[0].Secure != secure {
+			t.Errorf("Over TLS %v the cookie's Secure is %v", secure, cookies[0].Secure)
+		}
+	}
+}
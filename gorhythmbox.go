@@ -1,8 +1,18 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ae0000/gorhythmbox/rhythmbox"
 	"github.com/codegangsta/martini"
@@ -16,10 +26,39 @@ type PageData struct {
 	Album     rhythmbox.Item
 	Artist    rhythmbox.Entry
 	PageType  string
-	Selected  int
+	Selected  int // Track to highlight, -1 for none
 	ShowTitle bool
+	Seed      int64  // Shuffle that was just played
+	Mode      string // and how it was shuffled
+	AutoDJ    rhythmbox.AutoDJ
+	Playlists []rhythmbox.Playlist
+	Scores    []rhythmbox.RadioScore
+	Weights   rhythmbox.RadioWeights
+	Mix       rhythmbox.Mix
+	Form      url.Values   // What was asked for, to fill the form back in
+	Query     template.URL // The same again, for links
+	Genres    []rhythmbox.Item
+	Artists   []rhythmbox.Item
+	Schedules []rhythmbox.Schedule
+	Schedule  rhythmbox.Schedule // Being edited
+	RunLog    []rhythmbox.ScheduleRun
+	Plays     []rhythmbox.Play
+	Count     int
+	Stats     rhythmbox.Stats
+	Older     int // Offsets to the periods either side
+	Newer     int
+	Error     string
 }
 
+// Plays shown on the history page, the export has them all
+const historyPageSize = 500
+
+// Seconds browsers can keep album art before checking it has not changed
+const artMaxAge = 3600
+
+// What the alarm form starts with
+var newAlarm = rhythmbox.Schedule{Enabled: true, Hour: 7, Volume: 0.5, FadeIn: 60}
+
 type AjaxReturn struct {
 	A,
 	B,
@@ -30,25 +69,131 @@ type AjaxReturn struct {
 
 func main() {
 	fmt.Println("***************************************************** [START]")
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Printf("[ERRO] %v\n", err)
+		os.Exit(1)
+	}
+
 	// Setup Rhythmbox
 	rb := rhythmbox.Client{}
-	rb.GuessLibrary()
+	cfg.apply(&rb)
+
+	// Managing logins, rather than serving
+	if len(args) > 0 {
+		if err := usersCommand(rb.DataDir, args); err != nil {
+			fmt.Printf("[ERRO] %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Printf("[ERRO] %v\n", err)
+		os.Exit(1)
+	}
+	users := loadUsers(rb.DataDir)
+	users.secure = len(cfg.TLSCert) > 0
+
+	fmt.Println("[INFO] Library: " + rb.Library)
 	rb.Setup()
 
+	for _, run := range background(&rb, cfg.Features) {
+		go run()
+	}
+
+	// Templates and public files are built in, unless overridden
+	files := assets{dir: cfg.Assets}
+	templates, err := files.writeTemplates(filepath.Join(cfg.CacheDir, "templates"))
+	if err != nil {
+		fmt.Printf("[ERRO] Could not write out the templates: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Setup martini
-	m := martini.Classic()
+	m := newMartini(files)
+	m.Use(csrf)
+	m.Use(users.check)
 	m.Use(render.Renderer(render.Options{
-		Directory:  "templates",
+		Directory:  templates,
 		Layout:     "layout",
 		Extensions: []string{".tmpl", ".html"},
+		Funcs:      []template.FuncMap{{"feature": cfg.Features.On}},
 	}))
 
+	routes(m, &rb, users, cfg.Features)
+
+	fmt.Println("[INFO] Listening on " + cfg.Listen)
+	if len(cfg.TLSCert) > 0 {
+		err = http.ListenAndServeTLS(cfg.Listen, cfg.TLSCert, cfg.TLSKey, m)
+	} else {
+		err = http.ListenAndServe(cfg.Listen, m)
+	}
+	fmt.Printf("[ERRO] %v\n", err)
+	os.Exit(1)
+}
+
+// What runs alongside the server, by name. The player is always watched, the
+// rest only when their feature is on.
+func background(rb *rhythmbox.Client, features Features) map[string]func() {
+	jobs := map[string]func(){
+		// Keep an eye on the player so we can push changes out
+		"watch": func() { rb.Watch(rhythmbox.WatchInterval) },
+	}
+
+	// Alarms and anything else scheduled
+	if features.Alarms {
+		jobs["alarms"] = rb.RunSchedules
+	}
+
+	// Send plays on to ListenBrainz, Last.fm and the like
+	if features.Scrobbling {
+		jobs["scrobbler"] = rb.RunScrobbler
+	}
+	return jobs
+}
+
+// Everything we serve, apart from the public files
+func routes(m *martini.ClassicMartini, rb *rhythmbox.Client, users *Users, features Features) {
+	// Logging in, and what each role may do
+	authRoutes(m, users)
+	dj := needs(RoleDJ)
+	admin := needs(RoleAdmin)
+
+	// JSON, for our own clients
+	if features.API {
+		apiRoutes(m, rb, dj, admin)
+	}
+	alarms := feature(features.Alarms)
+
 	m.Get("/", func(r render.Render) {
 		p := PageData{Name: "Home"}
 		r.HTML(200, "home", p)
 	})
 
+	// Reading only, anything that changes the player is a POST
 	m.Get("/ajax/:do", func(r render.Render, params martini.Params) {
+		switch params["do"] {
+		case "current":
+			r.JSON(200, rb.NowPlaying())
+		case "volume":
+			volume, err := rb.Volume()
+			if err != nil {
+				fmt.Printf("[ERRO] Could not read the volume: %v\n", err)
+				r.JSON(500, AjaxReturn{A: "Could not read the volume"})
+				return
+			}
+			r.JSON(200, AjaxReturn{A: strconv.FormatFloat(volume, 'f', 2, 64)})
+		case "state":
+			r.JSON(200, rb.State())
+		default:
+			r.JSON(405, AjaxReturn{A: "Use POST for " + params["do"]})
+		}
+	})
+
+	m.Post("/ajax/:do", admin, func(r render.Render, params martini.Params) {
 		switch params["do"] {
 		case "previous":
 			rb.Previous()
@@ -63,14 +208,133 @@ func main() {
 			rb.VolumeUp()
 		case "volumedown":
 			rb.VolumeDown()
-		case "current":
-			r.JSON(200, AjaxReturn{A: rb.PrintPlayingFormat("<strong>%" + "aa:</strong><em> " + "%" + "tt</em>")})
+		case "shuffle":
+			rb.ToggleShuffle()
+		case "repeat":
+			rb.ToggleRepeat()
+		default:
+			r.JSON(404, AjaxReturn{A: "Unknown action: " + params["do"]})
 			return
 		}
 
 		r.JSON(200, PageData{Name: "Next"}) //  HTML(200, "home", p)
 	})
 
+	// Guest DJs can add to the queue, and nothing else
+	m.Post("/ajax/enqueue/:trackid", dj, func(r render.Render, params martini.Params) {
+		id, err := parseId(params["trackid"])
+		if err == nil {
+			err = rb.EnqueueTrack(id)
+		}
+		if err != nil {
+			ajaxError(r, err)
+			return
+		}
+		r.JSON(200, PageData{Name: "enqueue"})
+	})
+
+	m.Post("/ajax/playnext/:trackid", dj, func(r render.Render, params martini.Params) {
+		id, err := parseId(params["trackid"])
+		if err == nil {
+			_, err = rb.GetTrack(id)
+		}
+		if err != nil {
+			ajaxError(r, err)
+			return
+		}
+		rb.PlayNext(id)
+		r.JSON(200, PageData{Name: "playnext"})
+	})
+
+	m.Post("/ajax/:do/:value", admin, func(r render.Render, params martini.Params) {
+		value := params["value"]
+
+		var err error
+		switch params["do"] {
+		case "seek":
+			// Relative, in seconds
+			var seconds int64
+			seconds, err = strconv.ParseInt(value, 10, 0)
+			if err == nil {
+				rb.Seek(int(seconds))
+			}
+		case "seekto":
+			// Absolute position, in seconds
+			var position int64
+			position, err = strconv.ParseInt(value, 10, 0)
+			if err == nil {
+				rb.SeekTo(int(position))
+			}
+		case "volume":
+			// 0 - 1
+			var volume float64
+			volume, err = strconv.ParseFloat(value, 64)
+			if err == nil {
+				rb.SetVolume(volume)
+			}
+		case "rating":
+			// 0 - 5 stars
+			var rating int64
+			rating, err = strconv.ParseInt(value, 10, 0)
+			if err == nil {
+				rb.SetRating(int(rating))
+			}
+		case "sleep":
+			// A number of minutes, track, queue or cancel
+			switch value {
+			case "cancel":
+				rb.CancelSleep()
+			case rhythmbox.SleepTrack, rhythmbox.SleepQueue:
+				err = rb.StartSleep(value, 0)
+			default:
+				var minutes int64
+				minutes, err = strconv.ParseInt(value, 10, 0)
+				if err == nil {
+					err = rb.StartSleep(rhythmbox.SleepMinutes, int(minutes))
+				}
+			}
+		default:
+			r.JSON(404, AjaxReturn{A: "Unknown action: " + params["do"]})
+			return
+		}
+		if err != nil {
+			ajaxError(r, err)
+			return
+		}
+
+		r.JSON(200, PageData{Name: params["do"]})
+	})
+
+	// Server-Sent Events, so browsers hear about changes as they happen
+	m.Get("/events", func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		events := rb.Events.Subscribe()
+		defer rb.Events.Unsubscribe(events)
+
+		// Start them off with what we know
+		sendEvent(w, rhythmbox.Event{Type: rhythmbox.EventState, State: rb.State()})
+		flusher.Flush()
+
+		for {
+			select {
+			case e := <-events:
+				sendEvent(w, e)
+				flusher.Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+
 	m.Get("/albums", func(r render.Render) {
 		p := PageData{
 			Name:      "Albums",
@@ -99,243 +363,821 @@ func main() {
 		r.HTML(200, "genres", p)
 	})
 
-	m.Get("/albums/:albumid", func(r render.Render, params martini.Params) {
-		albumid := params["albumid"]
-
-		// Need to convert to Int
-		aid, _ := strconv.ParseInt(albumid, 10, 0)
-		adi := int(aid)
-
-		p := PageData{Name: "Album", Album: rb.GetAlbum(adi), PageId: albumid}
-
+	// Takes seed, mode and selected, from the POST that played something
+	m.Get("/albums/:albumid", func(r render.Render, params martini.Params, req *http.Request) {
+		p, _, err := albumPage(rb, params["albumid"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		p.played(req.URL.Query())
 		r.HTML(200, "album", p)
 	})
 
-	m.Get("/album/:albumid/track/:trackid", func(r render.Render, params martini.Params) {
-		albumid := params["albumid"]
-		trackid := params["trackid"]
-
-		// Need to convert to Int
-		aid, _ := strconv.ParseInt(albumid, 10, 0)
-		adi := int(aid)
-		id, _ := strconv.ParseInt(trackid, 10, 0)
-		idi := int(id)
+	m.Post("/album/:albumid/track/:trackid", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := albumPage(rb, params["albumid"])
+		var trackId int
+		if err == nil {
+			trackId, err = parseId(params["trackid"])
+		}
+		if err == nil {
+			// Carry on with the rest of the album, shuffled if shuffle is on
+			err = rb.PlayAlbumFrom(id, trackId, rb.State().Shuffle)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/albums/"+strconv.Itoa(id), url.Values{"selected": {strconv.Itoa(trackId)}})
+	})
 
-		album := rb.GetAlbum(adi)
-		album.SelectTrack(idi)
+	m.Post("/album/enqueue/:albumid", dj, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := albumPage(rb, params["albumid"])
+		if err == nil {
+			err = rb.EnqueueAlbum(id)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/albums/"+strconv.Itoa(id), nil)
+	})
 
-		p := PageData{
-			Name:   "Albums",
-			Album:  album,
-			PageId: albumid,
+	m.Post("/album/play/:albumid", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := albumPage(rb, params["albumid"])
+		if err == nil {
+			err = rb.PlayAlbum(id)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
 		}
+		seeOther(w, req, "/albums/"+strconv.Itoa(id), nil)
+	})
 
-		rb.PlayTrack(idi)
+	// The seed is optional, passing one plays a shuffle again
+	albumRandom := func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := albumPage(rb, params["albumid"])
+		var seed int64
+		if err == nil {
+			seed, err = parseSeed(params["seed"])
+		}
+		if err == nil {
+			seed, err = rb.PlayAlbumRandomly(id, seed)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/albums/"+strconv.Itoa(id), url.Values{"seed": {strconv.FormatInt(seed, 10)}})
+	}
+	m.Post("/album/random/:albumid", admin, albumRandom)
+	m.Post("/album/random/:albumid/:seed", admin, albumRandom)
+
+	// Takes seed and mode, from the POST that played something
+	m.Get("/artist/:artistid", func(r render.Render, params martini.Params, req *http.Request) {
+		p, _, err := artistPage(rb, params["artistid"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		p.played(req.URL.Query())
+		r.HTML(200, "artist", p)
+	})
 
-		r.HTML(200, "album", p)
+	m.Post("/artist/enqueue/:artistid", dj, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := artistPage(rb, params["artistid"])
+		if err == nil {
+			err = rb.EnqueueArtist(id)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/artist/"+strconv.Itoa(id), nil)
 	})
 
-	m.Get("/album/enqueue/:albumid", func(r render.Render, params martini.Params) {
-		albumid := params["albumid"]
+	m.Post("/artist/play/:artistid", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := artistPage(rb, params["artistid"])
+		if err == nil {
+			err = rb.PlayArtist(id)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/artist/"+strconv.Itoa(id), nil)
+	})
 
-		// Need to convert artistid to Int
-		id, _ := strconv.ParseInt(albumid, 10, 0)
-		idi := int(id)
+	// The seed is optional, passing one plays a shuffle again. Add mode=smart
+	// for the weighted shuffle
+	artistRandom := func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := artistPage(rb, params["artistid"])
+		var seed int64
+		if err == nil {
+			seed, err = parseSeed(params["seed"])
+		}
+		// random or smart
+		mode := req.URL.Query().Get("mode")
+		if err == nil {
+			seed, err = rb.PlayArtistRandomly(id, seed, mode)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/artist/"+strconv.Itoa(id), url.Values{"seed": {strconv.FormatInt(seed, 10)}, "mode": {mode}})
+	}
+	m.Post("/artist/random/:artistid", admin, artistRandom)
+	m.Post("/artist/random/:artistid/:seed", admin, artistRandom)
 
-		p := PageData{Name: "Album", Album: rb.GetAlbum(idi), PageId: albumid}
+	m.Get("/queue", func(r render.Render) {
+		r.HTML(200, "queue", queuePage(rb))
+	})
 
-		rb.EnqueueAlbum(idi)
-		r.HTML(200, "album", p)
+	m.Post("/queue/clear", admin, func(w http.ResponseWriter, req *http.Request) {
+		rb.ClearQueue()
+		seeOther(w, req, "/queue", nil)
 	})
 
-	m.Get("/album/play/:albumid", func(r render.Render, params martini.Params) {
-		albumid := params["albumid"]
+	m.Post("/queue/remove/:position", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		position, err := parseId(params["position"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
 
-		// Need to convert artistid to Int
-		id, _ := strconv.ParseInt(albumid, 10, 0)
-		idi := int(id)
+		rb.RemoveFromQueue(position)
+		seeOther(w, req, "/queue", nil)
+	})
 
-		p := PageData{Name: "Album", Album: rb.GetAlbum(idi), PageId: albumid}
+	m.Post("/queue/up/:position", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		position, err := parseId(params["position"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
 
-		rb.PlayAlbum(idi)
-		r.HTML(200, "album", p)
+		rb.MoveInQueue(position, position-1)
+		seeOther(w, req, "/queue", nil)
 	})
 
-	m.Get("/album/random/:albumid", func(r render.Render, params martini.Params) {
-		albumid := params["albumid"]
-
-		// Need to convert artistid to Int
-		id, _ := strconv.ParseInt(albumid, 10, 0)
-		idi := int(id)
+	m.Post("/queue/down/:position", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		position, err := parseId(params["position"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
 
-		p := PageData{Name: "Album", Album: rb.GetAlbum(idi), PageId: albumid}
+		rb.MoveInQueue(position, position+1)
+		seeOther(w, req, "/queue", nil)
+	})
 
-		rb.PlayAlbumRandomly(idi)
-		r.HTML(200, "album", p)
+	m.Post("/queue/playnext/:trackid", dj, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		id, err := parseId(params["trackid"])
+		if err == nil {
+			_, err = rb.GetTrack(id)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		rb.PlayNext(id)
+		seeOther(w, req, "/queue", nil)
 	})
 
-	m.Get("/artist/:artistid", func(r render.Render, params martini.Params) {
-		artistid := params["artistid"]
+	m.Get("/autodj", func(r render.Render) {
+		r.HTML(200, "autodj", autoDJPage(rb))
+	})
 
-		// Need to convert artistid to Int
-		id, _ := strconv.ParseInt(artistid, 10, 0)
-		idi := int(id)
+	// Takes rule, seed (a track or playlist id, -1 for the current track), min
+	// and batch
+	m.Post("/autodj/start", admin, func(r render.Render, w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		q := req.Form
+		settings := rhythmbox.AutoDJ{Rule: q.Get("rule"), Seed: -1}
 
-		p := PageData{
-			Name:   "Album",
-			Albums: rb.GetArtistsAlbums(idi),
-			PageId: artistid,
-			Artist: rb.GetArtist(idi),
+		// Need to convert to Int
+		if seed, err := strconv.ParseInt(q.Get("seed"), 10, 0); err == nil {
+			settings.Seed = int(seed)
+		}
+		if settings.Rule == rhythmbox.AutoDJPlaylist {
+			playlist, _ := strconv.ParseInt(q.Get("playlist"), 10, 0)
+			settings.Seed = int(playlist)
+		}
+		min, _ := strconv.ParseInt(q.Get("min"), 10, 0)
+		settings.MinQueue = int(min)
+		batch, _ := strconv.ParseInt(q.Get("batch"), 10, 0)
+		settings.Batch = int(batch)
+
+		err := rb.StartAutoDJ(settings)
+		if err != nil {
+			p := autoDJPage(rb)
+			p.Error = err.Error()
+			r.HTML(400, "autodj", p)
+			return
 		}
+		seeOther(w, req, "/autodj", nil)
+	})
 
-		r.HTML(200, "artist", p)
+	m.Post("/autodj/stop", admin, func(w http.ResponseWriter, req *http.Request) {
+		rb.StopAutoDJ()
+		seeOther(w, req, "/autodj", nil)
 	})
 
-	m.Get("/artist/enqueue/:artistid", func(r render.Render, params martini.Params) {
-		artistid := params["artistid"]
+	// Start a station from a track, album or artist
+	m.Post("/radio/:kind/:id", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		id, err := parseId(params["id"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+
+		err = rb.StartRadio(params["kind"], id)
+		if err != nil {
+			p := autoDJPage(rb)
+			p.Error = err.Error()
+			r.HTML(400, "autodj", p)
+			return
+		}
+		seeOther(w, req, "/autodj", nil)
+	})
 
-		// Need to convert artistid to Int
-		id, _ := strconv.ParseInt(artistid, 10, 0)
-		idi := int(id)
+	// Show how a station would score the library
+	m.Get("/radio/debug/:kind/:id", func(r render.Render, params martini.Params) {
+		id, err := parseId(params["id"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
 
 		p := PageData{
-			Name:   "Album",
-			Albums: rb.GetArtistsAlbums(idi),
-			PageId: artistid,
-			Artist: rb.GetArtist(idi),
+			Name:     "Radio scores",
+			PageType: params["kind"],
+			PageId:   params["id"],
+			Weights:  rb.RadioWeights,
+		}
+		scores, err := rb.RadioScores(params["kind"], id)
+		if err != nil {
+			p.Error = err.Error()
 		}
+		// The top of the list is what matters
+		if len(scores) > 200 {
+			scores = scores[:200]
+		}
+		p.Scores = scores
 
-		rb.EnqueueArtist(idi)
-		r.HTML(200, "artist", p)
+		r.HTML(200, "radio", p)
 	})
 
-	m.Get("/artist/play/:artistid", func(r render.Render, params martini.Params) {
-		artistid := params["artistid"]
+	m.Get("/mix", func(r render.Render) {
+		p := PageData{Name: "Mix", PageType: "mix", Albums: rb.GetGenres(), Form: url.Values{}}
+		r.HTML(200, "mix", p)
+	})
 
-		// Need to convert artistid to Int
-		id, _ := strconv.ParseInt(artistid, 10, 0)
-		idi := int(id)
+	m.Get("/mix/preview", func(r render.Render, req *http.Request) {
+		p, _ := mixPage(rb, req.URL.Query())
+		r.HTML(200, "mix", p)
+	})
 
-		p := PageData{
-			Name:   "Album",
-			Albums: rb.GetArtistsAlbums(idi),
-			PageId: artistid,
-			Artist: rb.GetArtist(idi),
+	m.Post("/mix/play", admin, func(r render.Render, w http.ResponseWriter, req *http.Request) {
+		p, mix := mixPage(rb, req.URL.Query())
+		if len(mix.Tracks) == 0 {
+			r.HTML(400, "mix", p)
+			return
 		}
-
-		rb.PlayArtist(idi)
-		r.HTML(200, "artist", p)
+		rb.PlayMix(mix)
+		// The seed is pinned, so the preview is the mix that was played
+		seeOther(w, req, "/mix/preview", p.Form)
 	})
 
-	m.Get("/artist/random/:artistid", func(r render.Render, params martini.Params) {
-		artistid := params["artistid"]
+	m.Get("/mix/export.m3u", func(w http.ResponseWriter, req *http.Request) {
+		_, mix := mixPage(rb, req.URL.Query())
 
-		// Need to convert artistid to Int
-		id, _ := strconv.ParseInt(artistid, 10, 0)
-		idi := int(id)
+		w.Header().Set("Content-Type", "audio/x-mpegurl")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"mix-"+strconv.FormatInt(mix.Seed, 10)+".m3u\"")
+		fmt.Fprint(w, mix.M3U())
+	})
 
-		p := PageData{
-			Name:   "Album",
-			Albums: rb.GetArtistsAlbums(idi),
-			PageId: artistid,
-			Artist: rb.GetArtist(idi),
+	m.Get("/alarms", alarms, func(r render.Render) {
+		r.HTML(200, "alarms", alarmsPage(rb, newAlarm))
+	})
+
+	m.Get("/alarms/edit/:id", alarms, func(r render.Render, params martini.Params) {
+		id, err := parseId(params["id"])
+		if err != nil {
+			errorPage(r, err)
+			return
 		}
 
-		rb.PlayArtistRandomly(idi)
-		r.HTML(200, "artist", p)
+		s, ok := rb.GetSchedule(id)
+		if !ok {
+			p := alarmsPage(rb, newAlarm)
+			p.Error = "No such alarm"
+			r.HTML(404, "alarms", p)
+			return
+		}
+		r.HTML(200, "alarms", alarmsPage(rb, s))
 	})
 
-	m.Get("/genre/:genreid", func(r render.Render, params martini.Params) {
-		genreid := params["genreid"]
+	// Takes id (0 for a new one), name, enabled, time (hh:mm), day (0 - 6,
+	// Sunday first, repeated), kind, target_<kind> (artist:<id> or album:<id>
+	// for radio), volume (0 - 100) and fadein (seconds)
+	m.Post("/alarms/save", alarms, admin, func(r render.Render, w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		q := req.Form
+		s := rhythmbox.Schedule{
+			Name:    q.Get("name"),
+			Enabled: q.Get("enabled") == "1",
+			Kind:    q.Get("kind"),
+		}
 
-		// Need to convert genreid to Int
-		id, _ := strconv.ParseInt(genreid, 10, 0)
-		idi := int(id)
+		// Need to convert to Int
+		id, _ := strconv.ParseInt(q.Get("id"), 10, 0)
+		s.Id = int(id)
+		fmt.Sscanf(q.Get("time"), "%d:%d", &s.Hour, &s.Minute)
+		for _, d := range q["day"] {
+			day, err := strconv.ParseInt(d, 10, 0)
+			if err == nil && day >= 0 && day < 7 {
+				s.Days[day] = true
+			}
+		}
+		// Radio is artist:<id> or album:<id>
+		target := q.Get("target_" + s.Kind)
+		if i := strings.Index(target, ":"); i >= 0 && s.Kind == rhythmbox.ScheduleRadio {
+			s.RadioSeed, target = target[:i], target[i+1:]
+		}
+		s.Target = -1
+		if t, err := strconv.ParseInt(target, 10, 0); err == nil {
+			s.Target = int(t)
+		}
+		volume, _ := strconv.ParseFloat(q.Get("volume"), 64)
+		s.Volume = volume / 100
+		fadeIn, _ := strconv.ParseInt(q.Get("fadein"), 10, 0)
+		s.FadeIn = int(fadeIn)
+
+		err := rb.SaveSchedule(s)
+		if err != nil {
+			p := alarmsPage(rb, s)
+			p.Error = err.Error()
+			r.HTML(400, "alarms", p)
+			return
+		}
+		seeOther(w, req, "/alarms", nil)
+	})
 
-		p := PageData{
-			Name:   "Genre",
-			Album:  rb.GetGenreTracks(idi),
-			PageId: genreid,
+	m.Post("/alarms/delete/:id", alarms, admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		id, err := parseId(params["id"])
+		if err != nil {
+			errorPage(r, err)
+			return
 		}
 
-		r.HTML(200, "genre", p)
+		err = rb.DeleteSchedule(id)
+		if err != nil {
+			p := alarmsPage(rb, newAlarm)
+			p.Error = err.Error()
+			r.HTML(404, "alarms", p)
+			return
+		}
+		seeOther(w, req, "/alarms", nil)
 	})
 
-	m.Get("/genre/:genreid/track/:trackid", func(r render.Render, params martini.Params) {
-		genreid := params["genreid"]
-		trackid := params["trackid"]
+	// Try an alarm out now
+	m.Post("/alarms/run/:id", alarms, admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		id, err := parseId(params["id"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
 
-		// Need to convert to Int
-		gid, _ := strconv.ParseInt(genreid, 10, 0)
-		gidi := int(gid)
-		id, _ := strconv.ParseInt(trackid, 10, 0)
-		idi := int(id)
+		s, ok := rb.GetSchedule(id)
+		if !ok {
+			p := alarmsPage(rb, newAlarm)
+			p.Error = "No such alarm"
+			r.HTML(404, "alarms", p)
+			return
+		}
+		go rb.RunSchedule(s)
+		seeOther(w, req, "/alarms", nil)
+	})
 
-		album := rb.GetGenreTracks(gidi)
-		album.SelectTrack(idi)
+	// Takes artist, album, genre, from and to (yyyy-mm-dd) and skipped
+	m.Get("/history", func(r render.Render, req *http.Request) {
+		q := req.URL.Query()
+		plays := rb.History(historyFilter(q))
 
 		p := PageData{
-			Name:   "Genre",
-			Album:  album,
-			PageId: genreid,
+			Name:     "History",
+			PageType: "history",
+			Genres:   rb.GetGenres(),
+			Form:     q,
+			Query:    template.URL(q.Encode()),
+			Count:    len(plays),
 		}
+		// The rest can be exported
+		if len(plays) > historyPageSize {
+			plays = plays[:historyPageSize]
+		}
+		p.Plays = plays
 
-		rb.PlayTrack(idi)
+		r.HTML(200, "history", p)
+	})
 
-		r.HTML(200, "genre", p)
+	m.Get("/history/export.json", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"history.json\"")
+		json.NewEncoder(w).Encode(rb.History(historyFilter(req.URL.Query())))
 	})
 
-	m.Get("/genre/enqueue/:genreid", func(r render.Render, params martini.Params) {
-		genreid := params["genreid"]
+	m.Get("/history/export.csv", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"history.csv\"")
+
+		out := csv.NewWriter(w)
+		out.Write([]string{"started", "artist", "title", "album", "genre", "duration", "listened", "skipped"})
+		for _, play := range rb.History(historyFilter(req.URL.Query())) {
+			out.Write([]string{
+				play.Started.Format(time.RFC3339),
+				play.Artist,
+				play.Title,
+				play.Album,
+				play.Genre,
+				strconv.Itoa(play.Duration),
+				strconv.Itoa(play.Listened),
+				strconv.FormatBool(play.Skipped),
+			})
+		}
+		out.Flush()
+	})
 
-		// Need to convert genreid to Int
-		id, _ := strconv.ParseInt(genreid, 10, 0)
-		idi := int(id)
+	// Takes period (week, month or year) and offset (how many periods back)
+	m.Get("/stats", func(r render.Render, req *http.Request) {
+		r.HTML(200, "stats", statsPage(rb, req.URL.Query()))
+	})
+
+	m.Get("/stats.json", func(r render.Render, req *http.Request) {
+		r.JSON(200, statsPage(rb, req.URL.Query()).Stats)
+	})
+
+	m.Get("/stats/review/:year", func(r render.Render, params martini.Params) {
+		year, err := strconv.Atoi(params["year"])
+		if err != nil {
+			errorPage(r, badRequest("That isn't a year: "+params["year"]))
+			return
+		}
+		offset := time.Now().Year() - year
 
 		p := PageData{
-			Name:   "Genre",
-			Album:  rb.GetGenreTracks(idi),
-			PageId: genreid,
+			Name:     "Year in review",
+			PageType: "review",
+			PageId:   params["year"],
+			Stats:    rb.Stats(rhythmbox.StatsYear, offset),
+			Query:    template.URL(url.Values{"period": {rhythmbox.StatsYear}, "offset": {strconv.Itoa(offset)}}.Encode()),
+			Older:    year - 1,
+			Newer:    year + 1,
 		}
+		r.HTML(200, "review", p)
+	})
 
-		rb.EnqueueGenre(idi)
+	// Takes seed, mode and selected, from the POST that played something
+	m.Get("/genre/:genreid", func(r render.Render, params martini.Params, req *http.Request) {
+		p, _, err := genrePage(rb, params["genreid"])
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		p.played(req.URL.Query())
 		r.HTML(200, "genre", p)
 	})
 
-	m.Get("/genre/play/:genreid", func(r render.Render, params martini.Params) {
-		genreid := params["genreid"]
+	m.Post("/genre/:genreid/track/:trackid", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := genrePage(rb, params["genreid"])
+		var trackId int
+		if err == nil {
+			trackId, err = parseId(params["trackid"])
+		}
+		if err == nil {
+			// Carry on with the rest of the genre, shuffled if shuffle is on
+			err = rb.PlayGenreFrom(id, trackId, rb.State().Shuffle)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/genre/"+strconv.Itoa(id), url.Values{"selected": {strconv.Itoa(trackId)}})
+	})
+
+	m.Post("/genre/enqueue/:genreid", dj, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := genrePage(rb, params["genreid"])
+		if err == nil {
+			err = rb.EnqueueGenre(id)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/genre/"+strconv.Itoa(id), nil)
+	})
 
-		// Need to convert genreid to Int
-		id, _ := strconv.ParseInt(genreid, 10, 0)
-		idi := int(id)
+	m.Post("/genre/play/:genreid", admin, func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := genrePage(rb, params["genreid"])
+		if err == nil {
+			err = rb.PlayGenre(id)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/genre/"+strconv.Itoa(id), nil)
+	})
 
-		p := PageData{
-			Name:   "Genre",
-			Album:  rb.GetGenreTracks(idi),
-			PageId: genreid,
+	// The seed is optional, passing one plays a shuffle again. Add mode=smart
+	// for the weighted shuffle
+	genreRandom := func(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params) {
+		_, id, err := genrePage(rb, params["genreid"])
+		var seed int64
+		if err == nil {
+			seed, err = parseSeed(params["seed"])
+		}
+		// random or smart
+		mode := req.URL.Query().Get("mode")
+		if err == nil {
+			seed, err = rb.PlayGenreRandomly(id, seed, mode)
+		}
+		if err != nil {
+			errorPage(r, err)
+			return
+		}
+		seeOther(w, req, "/genre/"+strconv.Itoa(id), url.Values{"seed": {strconv.FormatInt(seed, 10)}, "mode": {mode}})
+	}
+	m.Post("/genre/random/:genreid", admin, genreRandom)
+	m.Post("/genre/random/:genreid/:seed", admin, genreRandom)
+
+	// Album covers, found and cached the first time they are asked for
+	// Plain errors, these end up in img tags rather than in front of anyone
+	m.Get("/art/album/:id", func(w http.ResponseWriter, req *http.Request, params martini.Params) {
+		id, err := parseId(params["id"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		art, err := rb.AlbumArt(id)
+		if rhythmbox.IsNotFound(err) {
+			http.NotFound(w, req)
+			return
+		}
+		if err != nil {
+			fmt.Printf("[ERRO] Could not get album art: %v\n", err)
+			http.Error(w, "Could not get album art", http.StatusInternalServerError)
+			return
+		}
+		f, err := os.Open(art.Path)
+		if err != nil {
+			fmt.Printf("[ERRO] Could not open album art: %v\n", err)
+			http.Error(w, "Could not get album art", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
 
-		rb.PlayGenre(idi)
-		r.HTML(200, "genre", p)
+		// Browsers check back with the ETag once it is stale
+		w.Header().Set("Content-Type", art.ContentType)
+		w.Header().Set("ETag", `"`+art.Hash+`"`)
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(artMaxAge))
+		http.ServeContent(w, req, "", art.ModTime, f)
 	})
 
-	m.Get("/genre/random/:genreid", func(r render.Render, params martini.Params) {
-		genreid := params["genreid"]
+	m.NotFound(func(r render.Render, req *http.Request) {
+		r.HTML(404, "error", PageData{Name: "Not found", Error: "Nothing at " + req.URL.Path})
+	})
+}
 
-		// Need to convert genreid to Int
-		id, _ := strconv.ParseInt(genreid, 10, 0)
-		idi := int(id)
+// Post/Redirect/Get: once a POST has done what it was asked, send the browser
+// on to a page that reloading, or going back to, won't do it again. Anything
+// the page should show about what was done goes in q.
+func seeOther(w http.ResponseWriter, req *http.Request, path string, q url.Values) {
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	http.Redirect(w, req, path, http.StatusSeeOther)
+}
 
-		p := PageData{
-			Name:   "Genre",
-			Album:  rb.GetGenreTracks(idi),
-			PageId: genreid,
+// Fill in what was just played, from seeOther's q
+func (p *PageData) played(q url.Values) {
+	p.Seed, _ = strconv.ParseInt(q.Get("seed"), 10, 64)
+	p.Mode = q.Get("mode")
+	if selected, err := strconv.Atoi(q.Get("selected")); err == nil {
+		p.Selected = selected
+	}
+}
+
+// A bad value in the URL, gets the 400 page
+type badRequest string
+
+func (e badRequest) Error() string {
+	return string(e)
+}
+
+// Need to convert ids from the URL to Int
+func parseId(s string) (int, error) {
+	id, err := strconv.ParseInt(s, 10, 0)
+	if err != nil {
+		return 0, badRequest("That isn't an id: " + s)
+	}
+	return int(id), nil
+}
+
+// Shuffle seeds are optional, zero picks a new one
+func parseSeed(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	seed, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, badRequest("That isn't a seed: " + s)
+	}
+	return seed, nil
+}
+
+// 404 for things that aren't in the library, 400 for anything else
+func errorStatus(err error) int {
+	if rhythmbox.IsNotFound(err) {
+		return 404
+	}
+	return 400
+}
+
+func errorPage(r render.Render, err error) {
+	status, name := errorStatus(err), "Bad request"
+	if status == 404 {
+		name = "Not found"
+	}
+	r.HTML(status, "error", PageData{Name: name, Error: err.Error()})
+}
+
+// The same for the ajax calls
+func ajaxError(r render.Render, err error) {
+	r.JSON(errorStatus(err), AjaxReturn{A: err.Error()})
+}
+
+func albumPage(rb *rhythmbox.Client, albumid string) (PageData, int, error) {
+	id, err := parseId(albumid)
+	if err != nil {
+		return PageData{}, 0, err
+	}
+	album, err := rb.GetAlbum(id)
+	if err != nil {
+		return PageData{}, 0, err
+	}
+	return PageData{Name: "Album", Album: album, PageId: albumid, Selected: -1}, id, nil
+}
+
+func artistPage(rb *rhythmbox.Client, artistid string) (PageData, int, error) {
+	id, err := parseId(artistid)
+	if err != nil {
+		return PageData{}, 0, err
+	}
+	artist, err := rb.GetArtist(id)
+	if err != nil {
+		return PageData{}, 0, err
+	}
+	albums, err := rb.GetArtistsAlbums(id)
+	if err != nil {
+		return PageData{}, 0, err
+	}
+	return PageData{Name: "Album", Albums: albums, PageId: artistid, Artist: artist}, id, nil
+}
+
+func genrePage(rb *rhythmbox.Client, genreid string) (PageData, int, error) {
+	id, err := parseId(genreid)
+	if err != nil {
+		return PageData{}, 0, err
+	}
+	genre, err := rb.GetGenreTracks(id)
+	if err != nil {
+		return PageData{}, 0, err
+	}
+	return PageData{Name: "Genre", Album: genre, PageId: genreid, Selected: -1}, id, nil
+}
+
+func queuePage(rb *rhythmbox.Client) PageData {
+	return PageData{
+		Name:     "Up next",
+		PageType: "queue",
+		Album:    rhythmbox.Item{Name: "Up next", Tracks: rb.UpNext()},
+	}
+}
+
+// The Auto-DJ page
+func autoDJPage(rb *rhythmbox.Client) PageData {
+	return PageData{
+		Name:      "Auto-DJ",
+		PageType:  "autodj",
+		AutoDJ:    rb.AutoDJ(),
+		Playlists: rb.Playlists,
+	}
+}
+
+// Build a mix from the form on the mix page. Takes genre, from and to (years),
+// rating, artists (comma separated), minutes, tolerance (minutes), albumorder
+// and seed.
+func mixPage(rb *rhythmbox.Client, q url.Values) (PageData, rhythmbox.Mix) {
+	req := rhythmbox.MixRequest{AlbumOrder: q.Get("albumorder") == "1"}
+	req.Genre = q.Get("genre")
+
+	// Need to convert to Int
+	from, _ := strconv.ParseInt(q.Get("from"), 10, 0)
+	req.FromYear = int(from)
+	to, _ := strconv.ParseInt(q.Get("to"), 10, 0)
+	req.ToYear = int(to)
+	rating, _ := strconv.ParseInt(q.Get("rating"), 10, 0)
+	req.MinRating = int(rating)
+	minutes, _ := strconv.ParseFloat(q.Get("minutes"), 64)
+	req.Length = int(minutes * 60)
+	tolerance, _ := strconv.ParseFloat(q.Get("tolerance"), 64)
+	req.Tolerance = int(tolerance * 60)
+	req.Seed, _ = strconv.ParseInt(q.Get("seed"), 10, 64)
+	for _, a := range strings.Split(q.Get("artists"), ",") {
+		if len(strings.TrimSpace(a)) > 0 {
+			req.Artists = append(req.Artists, a)
 		}
+	}
+
+	p := PageData{Name: "Mix", PageType: "mix", Albums: rb.GetGenres()}
+	mix, err := rb.GenerateMix(req)
+	if err != nil {
+		p.Error = err.Error()
+	}
+
+	// Pin the seed so play and export get exactly what was previewed
+	if mix.Seed != 0 {
+		q.Set("seed", strconv.FormatInt(mix.Seed, 10))
+	}
+	p.Mix = mix
+	p.Form = q
+	p.Query = template.URL(q.Encode())
+
+	return p, mix
+}
 
-		rb.PlayGenreRandomly(idi)
-		r.HTML(200, "genre", p)
-	})
+// The alarms page, with the form filled in from s
+func alarmsPage(rb *rhythmbox.Client, s rhythmbox.Schedule) PageData {
+	return PageData{
+		Name:      "Alarms",
+		PageType:  "alarms",
+		Albums:    rb.GetAlbums(),
+		Genres:    rb.GetGenres(),
+		Artists:   rb.GetArtists(),
+		Playlists: rb.Playlists,
+		Schedules: rb.Schedules(),
+		Schedule:  s,
+		RunLog:    rb.ScheduleLog(),
+	}
+}
 
-	m.Run()
+// Build a history filter from the filter form, dates are yyyy-mm-dd
+func historyFilter(q url.Values) rhythmbox.HistoryFilter {
+	f := rhythmbox.HistoryFilter{
+		Artist:      q.Get("artist"),
+		Album:       q.Get("album"),
+		Genre:       q.Get("genre"),
+		SkippedOnly: q.Get("skipped") == "1",
+	}
+	if from, err := time.ParseInLocation("2006-01-02", q.Get("from"), time.Local); err == nil {
+		f.From = from
+	}
+	if to, err := time.ParseInLocation("2006-01-02", q.Get("to"), time.Local); err == nil {
+		// Up to the end of that day
+		f.To = to.AddDate(0, 0, 1)
+	}
+	return f
+}
+
+// The stats page, q has period and offset
+func statsPage(rb *rhythmbox.Client, q url.Values) PageData {
+	// Need to convert offset to Int
+	offset, _ := strconv.ParseInt(q.Get("offset"), 10, 0)
+	if offset < 0 {
+		offset = 0
+	}
+
+	stats := rb.Stats(q.Get("period"), int(offset))
+	return PageData{
+		Name:     "Stats",
+		PageType: stats.Period,
+		Stats:    stats,
+		Query:    template.URL(url.Values{"period": {stats.Period}, "offset": {strconv.Itoa(int(offset))}}.Encode()),
+		Older:    int(offset) + 1,
+		Newer:    int(offset) - 1,
+	}
+}
 
+// Write an event in the text/event-stream format
+func sendEvent(w http.ResponseWriter, e rhythmbox.Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Printf("[ERRO] Could not encode event: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
 }
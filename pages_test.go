@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ae0000/gorhythmbox/rhythmbox"
+)
+
+// Two albums of two tracks, played through a client that does nothing
+func testLibrary(t *testing.T) *rhythmbox.Client {
+	dir := t.TempDir()
+	xml := `<rhythmdb version="1.8">` + "\n"
+	for _, a := range []string{"Aalbum", "Balbum"} {
+		for n := 1; n <= 2; n++ {
+			xml += fmt.Sprintf(`<entry type="song"><title>%v %d</title><genre>Rock</genre><artist>Amy</artist>`+
+				`<album>%v</album><duration>200</duration><track-number>%d</track-number>`+
+				`<location>file://%v/%v/%d.mp3</location></entry>`+"\n",
+				a, n, a, n, dir, a, n)
+		}
+	}
+	xml += "</rhythmdb>\n"
+	library := filepath.Join(dir, "rhythmdb.xml")
+	if err := ioutil.WriteFile(library, []byte(xml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rb := &rhythmbox.Client{
+		Library:      library,
+		DataDir:      filepath.Join(dir, "data"),
+		ArtDir:       filepath.Join(dir, "art"),
+		ClientBinary: "true",
+	}
+	rb.Setup()
+	return rb
+}
+
+func TestErrorStatus(t *testing.T) {
+	rb := testLibrary(t)
+	pages := map[string]func(*rhythmbox.Client, string) (PageData, int, error){
+		"album":  albumPage,
+		"artist": artistPage,
+		"genre":  genrePage,
+	}
+	tests := []struct {
+		id   string
+		want int // 0 for no error
+	}{
+		{"0", 0},
+		{"3", 0},
+		{"4", 404},
+		{"-1", 404},
+		{"99999999999", 404},
+		{"", 400},
+		{"abc", 400},
+		{"1.5", 400},
+		{"99999999999999999999", 400},
+	}
+
+	for name, page := range pages {
+		for _, tt := range tests {
+			_, _, err := page(rb, tt.id)
+			got := 0
+			if err != nil {
+				got = errorStatus(err)
+			}
+			if got != tt.want {
+				t.Errorf("%v %q: got %v (%v), want %v", name, tt.id, got, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestErrorStatusPlay(t *testing.T) {
+	rb := testLibrary(t)
+
+	// A track from the other album
+	if err := rb.PlayAlbumFrom(0, 2, false); errorStatus(err) != 404 {
+		t.Errorf("Playing album 0 from track 2: got %v, want a 404", err)
+	}
+	if err := rb.PlayAlbumFrom(0, 1, false); err != nil {
+		t.Errorf("Playing album 0 from track 1: %v", err)
+	}
+
+	if _, err := parseSeed("x"); errorStatus(err) != 400 {
+		t.Errorf("Seed x: got %v, want a 400", err)
+	}
+	if seed, err := parseSeed(""); seed != 0 || err != nil {
+		t.Errorf("No seed: got %v, %v, want 0 for a new one", seed, err)
+	}
+}
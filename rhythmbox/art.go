@@ -0,0 +1,367 @@
+package rhythmbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Album art is looked for the first time it is asked for, then copied into the
+// art dir under a hash of what is in it. We look again when the album's dir,
+// or one under it, changes, and copy again when the file it came from does.
+// Copies that have been replaced are left where they are, a request may still
+// be serving one and another album may be using the same image. The art dir
+// can be cleared out any time gorhythmbox isn't running.
+
+// Cover file names, best first. Matched ignoring case.
+var DefaultArtPatterns = []string{"cover.*", "folder.*", "front.*", "albumart*"}
+
+// Images that are never the cover
+var DefaultArtIgnore = []string{"back*", "*inlay*", "*tray*", "cd*", "disc*", "*booklet*"}
+
+// How many dirs down from the album's to look, Scans/Front.jpg is one down
+const artDepth = 2
+
+// What was found, or not found, is trusted this long before the disk is looked
+// at again. The now playing poll asks every few seconds.
+const artRecheck = 30 * time.Second
+
+// The album's dir has no art in it
+var errNoArt = errors.New("No album art")
+
+// What images can be, by what is in them rather than their name
+var artTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+type AlbumArt struct {
+	Path        string // The copy in the art dir
+	ContentType string
+	Hash        string    // sha256 of the image, for ETags
+	ModTime     time.Time // Of the file it was copied from
+}
+
+type artCache struct {
+	mu     sync.Mutex
+	albums map[int]artSource
+}
+
+// Where an album's art came from, and what we knew about it last time
+type artSource struct {
+	dir     string
+	dirTime time.Time // The latest of the dir's and the dirs under it
+	source  string    // Empty if the dir has no art
+	size    int64
+	modTime time.Time
+	art     AlbumArt
+	checked time.Time // When the dir and source were last looked at
+}
+
+// Where the cover for an album is served from
+func AlbumArtURL(id int) string {
+	return "/art/album/" + strconv.Itoa(id)
+}
+
+// The art for the album, a NotFoundError if it has none
+func (r *Client) AlbumArt(id int) (AlbumArt, error) {
+	e, err := r.GetTrack(id)
+	if err != nil || len(e.Album) == 0 {
+		return AlbumArt{}, NotFoundError{"album", id}
+	}
+	dir, err := locationDir(e.Location)
+	if err != nil {
+		return AlbumArt{}, NotFoundError{"album art", id}
+	}
+
+	r.art.mu.Lock()
+	s := r.art.albums[id]
+	r.art.mu.Unlock()
+
+	if s.dir == dir && time.Since(s.checked) < artRecheck {
+		if len(s.source) == 0 {
+			return AlbumArt{}, NotFoundError{"album art", id}
+		}
+		return s.art, nil
+	}
+
+	// Only look through the dir again if something in it has changed
+	dirTime, err := artDirTime(dir, 0)
+	if err != nil {
+		return AlbumArt{}, NotFoundError{"album art", id}
+	}
+	if s.dir != dir || !s.dirTime.Equal(dirTime) {
+		s = artSource{dir: dir, dirTime: dirTime, source: r.findArt(dir, e.Album)}
+	}
+
+	// Having no art is remembered too. Anything else, even the file going
+	// while it was copied, is tried again next time.
+	s, err = r.refreshArt(s)
+	if err == nil || err == errNoArt {
+		s.checked = time.Now()
+	}
+	r.art.mu.Lock()
+	if r.art.albums == nil {
+		r.art.albums = make(map[int]artSource)
+	}
+	r.art.albums[id] = s
+	r.art.mu.Unlock()
+
+	if err == errNoArt || os.IsNotExist(err) {
+		return AlbumArt{}, NotFoundError{"album art", id}
+	}
+	return s.art, err
+}
+
+// Whether the album's art is worth asking for, from what AlbumArt last found
+// rather than the disk. Only albums looked at lately and found to have none
+// are false, the rest are found out about when their art is asked for.
+func (r *Client) HasAlbumArt(id int) bool {
+	r.art.mu.Lock()
+	s, ok := r.art.albums[id]
+	r.art.mu.Unlock()
+	return !ok || len(s.source) > 0 || time.Since(s.checked) >= artRecheck
+}
+
+// Make sure the copy is there and up to date with the file it came from
+func (r *Client) refreshArt(s artSource) (artSource, error) {
+	if len(s.source) == 0 {
+		s.art = AlbumArt{}
+		return s, errNoArt
+	}
+	info, err := os.Stat(s.source)
+	if err != nil {
+		// Gone, so look through the dir again next time
+		s.dirTime = time.Time{}
+		s.source, s.art = "", AlbumArt{}
+		return s, err
+	}
+	if info.Size() == s.size && info.ModTime().Equal(s.modTime) {
+		if _, err := os.Stat(s.art.Path); err == nil {
+			return s, nil
+		}
+	}
+
+	art, err := r.copyArt(s.source)
+	if err != nil {
+		return s, err
+	}
+	art.ModTime = info.ModTime()
+	s.art, s.size, s.modTime = art, info.Size(), info.ModTime()
+	return s, nil
+}
+
+// Copy an image into the art dir, named by what is in it
+func (r *Client) copyArt(source string) (AlbumArt, error) {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return AlbumArt{}, err
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := artTypes[contentType]
+	if !ok {
+		return AlbumArt{}, errors.New(source + " is not an image we can serve")
+	}
+	sum := sha256.Sum256(data)
+	art := AlbumArt{
+		Hash:        hex.EncodeToString(sum[:]),
+		ContentType: contentType,
+	}
+	art.Path = filepath.Join(r.ArtDir, art.Hash+ext)
+
+	if _, err := os.Stat(art.Path); err == nil {
+		return art, nil
+	}
+	err = os.MkdirAll(r.ArtDir, 0755)
+	if err != nil {
+		return AlbumArt{}, err
+	}
+	// Written to the side first so nobody is served half an image. Each copy
+	// gets its own, two requests may be copying the same image.
+	f, err := ioutil.TempFile(r.ArtDir, art.Hash+"-*.new")
+	if err != nil {
+		return AlbumArt{}, err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), art.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return AlbumArt{}, err
+	}
+	return art, nil
+}
+
+// The best image for the cover in the dir or the dirs under it, or nothing.
+// Names matching the first of ArtPatterns win, then the next and so on, then
+// one named after the album. After that, or between two that rank the same,
+// the nearest to the album dir wins, then the biggest and squarest.
+func (r *Client) findArt(dir, album string) string {
+	patterns := r.ArtPatterns
+	if patterns == nil {
+		patterns = DefaultArtPatterns
+	}
+	ignore := r.ArtIgnore
+	if ignore == nil {
+		ignore = DefaultArtIgnore
+	}
+
+	var found []artCandidate
+	walkArt(dir, 0, func(path string, depth int) {
+		name := strings.ToLower(filepath.Base(path))
+		if matchAny(ignore, name) {
+			return
+		}
+		c := artCandidate{path: path, depth: depth, rank: len(patterns) + 1, score: artScore(path)}
+		for i, p := range patterns {
+			if ok, _ := filepath.Match(strings.ToLower(p), name); ok {
+				c.rank = i
+				break
+			}
+		}
+		if c.rank > len(patterns) && strings.EqualFold(strings.TrimSuffix(name, filepath.Ext(name)), album) {
+			c.rank = len(patterns)
+		}
+		found = append(found, c)
+	})
+	if len(found) == 0 {
+		return ""
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		if a.depth != b.depth {
+			return a.depth < b.depth
+		}
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		return a.path < b.path
+	})
+	return found[0].path
+}
+
+type artCandidate struct {
+	path  string
+	depth int
+	rank  int
+	score float64
+}
+
+// Bigger is better, but a long thin image is probably a spine or a scan of
+// the whole booklet. Only the header is read.
+func artScore(path string) float64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil || config.Width == 0 || config.Height == 0 {
+		return 0
+	}
+	short, long := float64(config.Width), float64(config.Height)
+	if short > long {
+		short, long = long, short
+	}
+	return short * short / long
+}
+
+// When the dir, or any under it down to artDepth, last had something added,
+// removed or renamed in it. Anything walkArt could find differently.
+func artDirTime(dir string, depth int) (time.Time, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := info.ModTime()
+	if depth >= artDepth {
+		return latest, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return latest, nil
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		t, err := artDirTime(filepath.Join(dir, f.Name()), depth+1)
+		if err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
+
+// Every image in the dir, and in the dirs under it down to artDepth
+func walkArt(dir string, depth int, found func(path string, depth int)) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		switch {
+		case f.IsDir() && depth < artDepth:
+			walkArt(path, depth+1, found)
+		case f.Mode().IsRegular() && isImage(f.Name()):
+			found(path, depth)
+		}
+	}
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(strings.ToLower(p), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+// The dir a track is in, from its file:// location
+func locationDir(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", errors.New("Not a local file: " + location)
+	}
+	return filepath.Dir(u.Path), nil
+}
@@ -0,0 +1,241 @@
+package rhythmbox
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A png of the size, at the path, with the dirs for it
+func writeImage(t *testing.T, path string, width, height int) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// As if artRecheck had gone by
+func expireArt(r *Client) {
+	r.art.mu.Lock()
+	for id, s := range r.art.albums {
+		s.checked = time.Time{}
+		r.art.albums[id] = s
+	}
+	r.art.mu.Unlock()
+}
+
+// Moves the file and its dir back in time, so a change after is seen even on
+// file systems with coarse times
+func backdate(t *testing.T, paths ...string) {
+	old := time.Now().Add(-time.Hour)
+	for _, p := range paths {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func albumDir(t *testing.T, r *Client, id int) string {
+	dir, err := locationDir(r.Db.Entries[id].Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestArtSourceReplaced(t *testing.T) {
+	r := testClient(t)
+	dir := albumDir(t, r, 0)
+	cover := filepath.Join(dir, "cover.png")
+	backdate(t, cover, dir)
+
+	before, err := r.AlbumArt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written over, the dir itself doesn't change
+	writeImage(t, cover, 16, 16)
+	expireArt(r)
+	after, err := r.AlbumArt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Hash == before.Hash {
+		t.Error("Still serving the old cover")
+	}
+	if _, err := os.Stat(after.Path); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestArtDirTouched(t *testing.T) {
+	r := testClient(t)
+	id := r.Albums[0].Id // Aalbum, which has no art
+	dir := albumDir(t, r, id)
+	scans := filepath.Join(dir, "Scans")
+	if err := os.Mkdir(scans, 0755); err != nil {
+		t.Fatal(err)
+	}
+	backdate(t, scans, dir)
+
+	if _, err := r.AlbumArt(id); !IsNotFound(err) {
+		t.Fatalf("Got %v for an album with no art, want a NotFoundError", err)
+	}
+	if r.HasAlbumArt(id) {
+		t.Error("HasAlbumArt for an album just found to have none")
+	}
+
+	// Only Scans changes
+	writeImage(t, filepath.Join(scans, "front.png"), 8, 8)
+	expireArt(r)
+	if !r.HasAlbumArt(id) {
+		t.Error("No HasAlbumArt once it is time to look again")
+	}
+	if _, err := r.AlbumArt(id); err != nil {
+		t.Errorf("Didn't find the art added under Scans: %v", err)
+	}
+	if !r.HasAlbumArt(id) {
+		t.Error("No HasAlbumArt after finding some")
+	}
+}
+
+func TestArtCopyDeleted(t *testing.T) {
+	r := testClient(t)
+	art, err := r.AlbumArt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(art.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	expireArt(r)
+	again, err := r.AlbumArt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(again.Path); err != nil {
+		t.Errorf("Not copied again: %v", err)
+	}
+
+	// Nothing left half written
+	left, _ := filepath.Glob(filepath.Join(r.ArtDir, "*.new"))
+	if len(left) > 0 {
+		t.Errorf("Left %v", left)
+	}
+}
+
+// A source that can't be copied is tried again, not remembered as no art
+func TestArtFailureNotCached(t *testing.T) {
+	r := testClient(t)
+	cover := filepath.Join(albumDir(t, r, 0), "cover.png")
+	if err := ioutil.WriteFile(cover, []byte("not a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AlbumArt(0); err == nil || IsNotFound(err) {
+		t.Fatalf("Got %v for a cover that isn't an image, want an error", err)
+	}
+
+	writeImage(t, cover, 8, 8)
+	if _, err := r.AlbumArt(0); err != nil {
+		t.Errorf("The fixed cover wasn't picked up: %v", err)
+	}
+}
+
+// Images by path under the album dir, and their sizes. The names say jpg but
+// they are all pngs, which is fine, only what is in them is looked at.
+type artFiles map[string][2]int
+
+func TestFindArt(t *testing.T) {
+	tests := []struct {
+		name  string
+		files artFiles
+		want  string
+	}{
+		{"cover beats folder", artFiles{"folder.jpg": {500, 500}, "cover.jpg": {100, 100}}, "cover.jpg"},
+		{"folder beats anything else", artFiles{"folder.jpg": {100, 100}, "big.jpg": {900, 900}}, "folder.jpg"},
+		{"case is ignored", artFiles{"Folder.JPG": {100, 100}, "COVER.Jpg": {100, 100}}, "COVER.Jpg"},
+		{"back is ignored", artFiles{"back.jpg": {500, 500}}, ""},
+		{"back is ignored for the rest", artFiles{"back.jpg": {500, 500}, "scan.jpg": {100, 100}}, "scan.jpg"},
+		{"named after the album", artFiles{"Zalbum.jpg": {100, 100}, "big.jpg": {900, 900}}, "Zalbum.jpg"},
+		{"patterns beat the album name", artFiles{"Zalbum.jpg": {900, 900}, "front.jpg": {100, 100}}, "front.jpg"},
+		{"depth 0 beats Scans", artFiles{"Scans/front.jpg": {900, 900}, "front.jpg": {100, 100}}, "front.jpg"},
+		{"Scans when that is all", artFiles{"Scans/front.jpg": {100, 100}, "Scans/back.jpg": {100, 100}}, "Scans/front.jpg"},
+		{"too deep", artFiles{"a/b/c/cover.jpg": {100, 100}}, ""},
+		{"square beats long and thin", artFiles{"a.jpg": {400, 50}, "b.jpg": {100, 100}}, "b.jpg"},
+		{"bigger beats smaller", artFiles{"a.jpg": {100, 100}, "b.jpg": {300, 300}}, "b.jpg"},
+		{"nothing", artFiles{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, size := range tt.files {
+				writeImage(t, filepath.Join(dir, name), size[0], size[1])
+			}
+			// Not an image, whatever it is called
+			ioutil.WriteFile(filepath.Join(dir, "cover.txt"), []byte("cover"), 0644)
+
+			r := &Client{}
+			got := r.findArt(dir, "Zalbum")
+			if len(tt.want) > 0 {
+				tt.want = filepath.Join(dir, tt.want)
+			}
+			if got != tt.want {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindArtPatterns(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, filepath.Join(dir, "cover.jpg"), 100, 100)
+	writeImage(t, filepath.Join(dir, "back.jpg"), 100, 100)
+
+	r := &Client{ArtPatterns: []string{"back.*", "cover.*"}, ArtIgnore: []string{}}
+	if got, want := r.findArt(dir, ""), filepath.Join(dir, "back.jpg"); got != want {
+		t.Errorf("Got %q with back.* first and nothing ignored, want %q", got, want)
+	}
+}
+
+func TestArtScore(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name  string
+		size  [2]int // None for a file that isn't an image
+		score float64
+	}{
+		{"square.png", [2]int{100, 100}, 100},
+		{"wide.png", [2]int{400, 100}, 25},
+		{"tall.png", [2]int{100, 400}, 25},
+		{"spine.png", [2]int{20, 400}, 1},
+		{"broken.png", [2]int{}, 0},
+		{"missing.png", [2]int{-1, -1}, 0},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		switch {
+		case tt.size[0] > 0:
+			writeImage(t, path, tt.size[0], tt.size[1])
+		case tt.size[0] == 0:
+			ioutil.WriteFile(path, []byte("not a png"), 0644)
+		}
+		if got := artScore(path); got != tt.score {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.score)
+		}
+	}
+}
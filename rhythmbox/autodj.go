@@ -0,0 +1,223 @@
+package rhythmbox
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// How the Auto-DJ picks what to add
+const (
+	AutoDJGenre    = "genre"    // Same genre as the seed track
+	AutoDJDecade   = "decade"   // Came out in the same decade as the seed track
+	AutoDJArtist   = "artist"   // The seed artist and artists they share albums or playlists with
+	AutoDJPlaylist = "playlist" // From a Rhythmbox playlist
+	AutoDJRadio    = "radio"    // The best scoring tracks for a radio station
+)
+
+// Auto-DJ settings and what it is doing
+type AutoDJ struct {
+	Running   bool   `json:"running"`
+	Rule      string `json:"rule"`
+	Seed      int    `json:"seed"`      // Entry the rule works from, or the playlist Id
+	RadioSeed string `json:"radioSeed"` // For radio, whether Seed is a track, album or artist
+	SeedName  string `json:"seedName"`  // Something to show for the seed
+	MinQueue  int    `json:"minQueue"`  // Top up when fewer than this many tracks are left
+	Batch     int    `json:"batch"`     // How many tracks to add each time
+	Added     int    `json:"added"`     // Tracks added since it started
+}
+
+var DefaultAutoDJ = AutoDJ{
+	Rule:     AutoDJGenre,
+	MinQueue: 3,
+	Batch:    5,
+}
+
+type autoDJState struct {
+	mu       sync.Mutex
+	settings AutoDJ
+	pool     []Entry      // Every track the rule allows, worked out when it starts
+	used     map[int]bool // Tracks already added, so we don't repeat until we run out
+	rng      *rand.Rand
+}
+
+// What the Auto-DJ is up to
+func (r *Client) AutoDJ() AutoDJ {
+	r.autoDJ.mu.Lock()
+	defer r.autoDJ.mu.Unlock()
+	return r.autoDJ.settings
+}
+
+// Start the Auto-DJ. For the track rules a seed of -1 means the current track.
+func (r *Client) StartAutoDJ(settings AutoDJ) error {
+	settings, pool, err := r.prepareAutoDJ(settings)
+	if err != nil {
+		return err
+	}
+	r.runAutoDJ(settings, pool)
+	return nil
+}
+
+// Check the settings and work out what they allow, without changing anything
+func (r *Client) prepareAutoDJ(settings AutoDJ) (AutoDJ, []Entry, error) {
+	if settings.MinQueue <= 0 {
+		settings.MinQueue = DefaultAutoDJ.MinQueue
+	}
+	if settings.Batch <= 0 {
+		settings.Batch = DefaultAutoDJ.Batch
+	}
+
+	switch settings.Rule {
+	case AutoDJGenre, AutoDJDecade, AutoDJArtist:
+		if settings.Seed < 0 {
+			settings.Seed = r.NowPlaying().Id
+		}
+		if settings.Seed < 0 || settings.Seed >= len(r.Db.Entries) {
+			return settings, nil, errors.New("Auto-DJ needs a track from the library to start from")
+		}
+		e := r.Db.Entries[settings.Seed]
+		settings.SeedName = e.Artist + " - " + e.Title
+		if settings.Rule == AutoDJDecade && e.Year() == 0 {
+			return settings, nil, errors.New("Auto-DJ does not know when " + e.Title + " came out")
+		}
+	case AutoDJRadio:
+		if err := r.RadioWeights.check(); err != nil {
+			return settings, nil, err
+		}
+		seeds, err := r.radioSeeds(settings.RadioSeed, settings.Seed)
+		if err != nil {
+			return settings, nil, err
+		}
+		e := seeds[0]
+		switch settings.RadioSeed {
+		case RadioTrack:
+			settings.SeedName = e.Artist + " - " + e.Title
+		case RadioAlbum:
+			settings.SeedName = e.Artist + " - " + e.Album
+		case RadioArtist:
+			settings.SeedName = e.Artist
+		}
+	case AutoDJPlaylist:
+		if settings.Seed < 0 || settings.Seed >= len(r.Playlists) {
+			return settings, nil, errors.New("Auto-DJ needs a playlist")
+		}
+		settings.SeedName = r.Playlists[settings.Seed].Name
+	default:
+		return settings, nil, errors.New("Unknown Auto-DJ rule: " + settings.Rule)
+	}
+
+	settings.Running = true
+	settings.Added = 0
+
+	// The library doesn't change, so neither does what the rule allows. This
+	// can take a while for the radio, so it is done before taking the lock.
+	pool := r.autoDJCandidates(settings)
+	if len(pool) == 0 {
+		return settings, nil, errors.New("Auto-DJ has nothing to play for " + settings.SeedName)
+	}
+	return settings, pool, nil
+}
+
+// Start the Auto-DJ on what prepareAutoDJ worked out
+func (r *Client) runAutoDJ(settings AutoDJ, pool []Entry) {
+	r.autoDJ.mu.Lock()
+	r.autoDJ.settings = settings
+	r.autoDJ.pool = pool
+	r.autoDJ.used = make(map[int]bool)
+	r.autoDJ.rng = rand.New(rand.NewSource(NewSeed()))
+	r.autoDJ.mu.Unlock()
+
+	// Get something going straight away
+	r.topUp()
+	if !r.State().NowPlaying.Playing {
+		r.Play()
+	}
+}
+
+func (r *Client) StopAutoDJ() {
+	r.autoDJ.mu.Lock()
+	r.autoDJ.settings.Running = false
+	r.autoDJ.mu.Unlock()
+}
+
+// Add tracks if the queue is running low, called by the watcher
+func (r *Client) topUp() {
+	upNext := r.UpNext()
+
+	r.autoDJ.mu.Lock()
+	settings := r.autoDJ.settings
+	if !settings.Running || len(upNext) >= settings.MinQueue {
+		r.autoDJ.mu.Unlock()
+		return
+	}
+
+	queued := make(map[int]bool)
+	for _, e := range upNext {
+		queued[e.Id] = true
+	}
+
+	var fresh []Entry
+	for _, e := range r.autoDJ.pool {
+		if !r.autoDJ.used[e.Id] && !queued[e.Id] {
+			fresh = append(fresh, e)
+		}
+	}
+	if len(fresh) == 0 {
+		// Played everything, start again
+		r.autoDJ.used = make(map[int]bool)
+		for _, e := range r.autoDJ.pool {
+			if !queued[e.Id] {
+				fresh = append(fresh, e)
+			}
+		}
+	}
+
+	r.autoDJ.rng.Shuffle(len(fresh), func(i, j int) {
+		fresh[i], fresh[j] = fresh[j], fresh[i]
+	})
+	if len(fresh) > settings.Batch {
+		fresh = fresh[:settings.Batch]
+	}
+	for _, e := range fresh {
+		r.autoDJ.used[e.Id] = true
+	}
+	r.autoDJ.settings.Added += len(fresh)
+	r.autoDJ.mu.Unlock()
+
+	for _, e := range fresh {
+		r.Enqueue(e.Location)
+	}
+}
+
+// Every track the rule allows, this looks through the whole library
+func (r *Client) autoDJCandidates(settings AutoDJ) []Entry {
+	switch settings.Rule {
+	case AutoDJPlaylist:
+		return r.GetPlaylistTracks(settings.Seed)
+	case AutoDJRadio:
+		return r.radioPool(settings.RadioSeed, settings.Seed)
+	}
+
+	seed := r.Db.Entries[settings.Seed]
+	var match func(Entry) bool
+
+	switch settings.Rule {
+	case AutoDJGenre:
+		match = func(e Entry) bool { return e.Genre == seed.Genre }
+	case AutoDJDecade:
+		decade := seed.Year() / 10
+		match = func(e Entry) bool { return e.Year() > 0 && e.Year()/10 == decade }
+	case AutoDJArtist:
+		// The same likeness the radio goes by
+		similar := r.artistLinks()[seed.Artist]
+		match = func(e Entry) bool { return e.Artist == seed.Artist || similar[e.Artist] > 0 }
+	}
+
+	var tracks []Entry
+	for _, e := range r.Db.Entries {
+		if e.Type == "song" && match(e) {
+			tracks = append(tracks, e)
+		}
+	}
+	return tracks
+}
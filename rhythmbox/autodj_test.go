@@ -0,0 +1,29 @@
+package rhythmbox
+
+import "testing"
+
+// Artists are similar when they share an album or playlist, a genre isn't
+// enough
+func TestAutoDJSimilarArtists(t *testing.T) {
+	r := &Client{}
+	r.Db.Entries = []Entry{
+		{Type: "song", Artist: "Amy", Album: "Solo", Genre: "Jazz"},
+		{Type: "song", Artist: "Amy", Album: "Together", Genre: "Jazz"},
+		{Type: "song", Artist: "Bo", Album: "Together", Genre: "Soul"},
+		{Type: "song", Artist: "Bo", Album: "Bo's", Genre: "Soul"},
+		{Type: "song", Artist: "Cy", Album: "Other", Genre: "Jazz"},
+	}
+	for i := range r.Db.Entries {
+		r.Db.Entries[i].Id = i
+	}
+
+	got := make(map[int]bool)
+	for _, e := range r.autoDJCandidates(AutoDJ{Rule: AutoDJArtist, Seed: 0}) {
+		got[e.Id] = true
+	}
+	for id, want := range []bool{true, true, true, true, false} {
+		if got[id] != want {
+			t.Errorf("Track %v by %v picked: %v, want %v", id, r.Db.Entries[id].Artist, got[id], want)
+		}
+	}
+}
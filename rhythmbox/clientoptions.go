@@ -1,5 +1,11 @@
 package rhythmbox
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // Debug
 func (r *Client) Debug() {
 	r.Execute("--debug")
@@ -20,6 +26,12 @@ func (r *Client) CheckRunning() {
 	r.Execute("--check-running")
 }
 
+// Whether Rhythmbox is running, asking doesn't start it
+func (r *Client) Running() bool {
+	_, err := r.output("--no-start", "--check-running")
+	return err == nil
+}
+
 // Don't present an existing Rhythmbox window
 func (r *Client) NoPresent() {
 	r.Execute("--no-present")
@@ -35,9 +47,28 @@ func (r *Client) Previous() {
 	r.Execute("--previous")
 }
 
-// Seek in current track
-func (r *Client) Seek() {
-	r.Execute("--seek")
+// Seek in current track by the given number of seconds, a negative number
+// seeks backwards
+func (r *Client) Seek(seconds int) {
+	r.Execute("--seek=" + strconv.Itoa(seconds))
+}
+
+// Seek to an absolute position (in seconds) in the current track
+func (r *Client) SeekTo(position int) {
+	if position < 0 {
+		position = 0
+	}
+	r.Seek(position - r.Elapsed())
+}
+
+// Seconds elapsed in the current track
+func (r *Client) Elapsed() int {
+	return ParseDuration(r.PrintPlayingFormat("%te"))
+}
+
+// Length of the current track in seconds
+func (r *Client) Duration() int {
+	return ParseDuration(r.PrintPlayingFormat("%td"))
 }
 
 // Resume playback if currently paused
@@ -45,9 +76,10 @@ func (r *Client) Play() {
 	r.Execute("--play")
 }
 
-// Pause playback if currently playing
+// Pause playback if currently playing, there is nothing to pause if
+// Rhythmbox isn't running
 func (r *Client) Pause() {
-	r.Execute("--pause")
+	r.Execute("--no-start", "--pause")
 }
 
 // Toggle play/pause mode
@@ -62,22 +94,31 @@ func (r *Client) PlayUri() {
 
 // Add specified tracks to the play queue
 func (r *Client) Enqueue(location string) {
+	r.queue.ops.Lock()
 	r.Execute("--enqueue", location)
+	r.queueAppend(location)
+	r.queue.ops.Unlock()
+	r.queueChanged()
 }
 
 // Empty the play queue before adding new tracks
 func (r *Client) ClearQueue() {
+	r.queue.ops.Lock()
 	r.Execute("--clear-queue")
+	r.queueClear()
+	r.queue.ops.Unlock()
+	r.queueChanged()
 }
 
-// Print the title and artist of the playing song
+// Print the title and artist of the playing song. Reading what is playing
+// never starts Rhythmbox, the watcher would keep starting it after it quit.
 func (r *Client) PrintPlaying() string {
-	return r.ExecuteAndReturn("--print-playing")
+	return r.ExecuteAndReturn("--no-start", "--print-playing")
 }
 
 // Print formatted details of the song
 func (r *Client) PrintPlayingFormat(format string) string {
-	return r.ExecuteAndReturn("--print-playing-format", format)
+	return r.ExecuteAndReturn("--no-start", "--print-playing-format", format)
 }
 
 // Select the source matching the specified URI
@@ -97,27 +138,75 @@ func (r *Client) PlaySource() {
 
 // Enable repeat playback order
 func (r *Client) Repeat() {
-	r.Execute("--repeat")
+	r.order.Lock()
+	defer r.order.Unlock()
+	r.setRepeat(true)
 }
 
 // Disable repeat playback order
 func (r *Client) NoRepeat() {
-	r.Execute("--no-repeat")
+	r.order.Lock()
+	defer r.order.Unlock()
+	r.setRepeat(false)
 }
 
 // Enable shuffle playback order
 func (r *Client) Shuffle() {
-	r.Execute("--shuffle")
+	r.order.Lock()
+	defer r.order.Unlock()
+	r.setShuffle(true)
 }
 
 // Disable shuffle playback order
 func (r *Client) NoShuffle() {
-	r.Execute("--no-shuffle")
+	r.order.Lock()
+	defer r.order.Unlock()
+	r.setShuffle(false)
 }
 
-// Set the playback volume
-func (r *Client) SetVolume() {
-	r.Execute("--set-volume")
+// Turn shuffle on if it is off, off if it is on
+func (r *Client) ToggleShuffle() {
+	r.order.Lock()
+	defer r.order.Unlock()
+	r.setShuffle(!r.State().Shuffle)
+}
+
+// Turn repeat on if it is off, off if it is on
+func (r *Client) ToggleRepeat() {
+	r.order.Lock()
+	defer r.order.Unlock()
+	r.setRepeat(!r.State().Repeat)
+}
+
+// Call with the order lock held
+func (r *Client) setShuffle(on bool) {
+	if on {
+		r.Execute("--shuffle")
+	} else {
+		r.Execute("--no-shuffle")
+	}
+	r.setOrder(on, r.State().Repeat)
+}
+
+// Call with the order lock held
+func (r *Client) setRepeat(on bool) {
+	if on {
+		r.Execute("--repeat")
+	} else {
+		r.Execute("--no-repeat")
+	}
+	r.setOrder(r.State().Shuffle, on)
+}
+
+// Set the playback volume, from 0 (mute) to 1 (full)
+func (r *Client) SetVolume(volume float64) {
+	if volume < 0 {
+		volume = 0
+	}
+	if volume > 1 {
+		volume = 1
+	}
+	r.Execute("--set-volume=" + strconv.FormatFloat(volume, 'f', 2, 64))
 }
 
 // Increase the playback volume
@@ -131,13 +220,35 @@ func (r *Client) VolumeDown() {
 }
 
 // Print the current playback volume
-func (r *Client) PrintVolume() {
-	r.Execute("--print-volume")
+func (r *Client) PrintVolume() string {
+	return r.ExecuteAndReturn("--no-start", "--print-volume")
+}
+
+// The current playback volume, from 0 to 1. The client prints something like
+// "Playback volume is 0.500000." so we just pull the number out. An error if
+// the client failed or printed something else, never a made up volume.
+func (r *Client) Volume() (float64, error) {
+	out, err := r.output("--no-start", "--print-volume")
+	if err != nil {
+		return 0, err
+	}
+	out = strings.TrimSuffix(strings.TrimSpace(out), ".")
+	volume, err := strconv.ParseFloat(out[strings.LastIndex(out, " ")+1:], 64)
+	if err != nil || volume < 0 || volume > 1 {
+		return 0, fmt.Errorf("Couldn't read the volume from %q", out)
+	}
+	return volume, nil
 }
 
-// Set the rating of the current song
-func (r *Client) SetRating() {
-	r.Execute("--set-rating")
+// Set the rating of the current song, from 0 to 5 stars
+func (r *Client) SetRating(rating int) {
+	if rating < 0 {
+		rating = 0
+	}
+	if rating > 5 {
+		rating = 5
+	}
+	r.Execute("--set-rating=" + strconv.Itoa(rating))
 }
 
 // FORMAT OPTIONS
@@ -0,0 +1,83 @@
+package rhythmbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Point the client at a script with the body, which can look at "$1"
+func scriptClient(t *testing.T, r *Client, body string) {
+	script := filepath.Join(t.TempDir(), "client")
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+body+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ClientBinary = script
+}
+
+func TestVolume(t *testing.T) {
+	tests := []struct {
+		script string
+		volume float64
+		ok     bool
+	}{
+		{"echo 'Playback volume is 0.500000.'", 0.5, true},
+		{"echo 'Playback volume is 1.000000.'", 1, true},
+		{"exit 1", 0, false},
+		{"echo 'Playback volume is 0.5.'; exit 1", 0, false},
+		{"echo 'Not running'", 0, false},
+		{"echo ''", 0, false},
+		{"echo 'Playback volume is 7.'", 0, false},
+	}
+
+	for _, tt := range tests {
+		r := &Client{}
+		scriptClient(t, r, tt.script)
+		volume, err := r.Volume()
+		if (err == nil) != tt.ok || volume != tt.volume {
+			t.Errorf("%v: got %v, %v, want %v", tt.script, volume, err, tt.volume)
+		}
+	}
+}
+
+// A client that can't be asked doesn't make a volume up
+func TestVolumeFailure(t *testing.T) {
+	r := testClient(t)
+	r.ClientBinary = "false"
+	r.watch.state.Volume = 0.4
+	events := r.Events.Subscribe()
+
+	r.poll()
+	if v := r.State().Volume; v != 0.4 {
+		t.Errorf("Volume is %v after a failed read, want 0.4 kept", v)
+	}
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventVolume {
+			t.Error("Sent out a volume event for a failed read")
+		}
+	}
+}
+
+// Without the volume to put back the sleep timer doesn't fade
+func TestSleepFadeNeedsVolume(t *testing.T) {
+	r := testClient(t)
+	log := logClient(t, r)
+	script, _ := ioutil.ReadFile(r.ClientBinary)
+	scriptClient(t, r, strings.TrimPrefix(string(script), "#!/bin/sh\n")+`[ "$1" != "--print-volume" ]`)
+
+	r.sleep.timer = SleepTimer{Running: true, Mode: SleepMinutes}
+	r.sleep.ends = time.Now().Add(SleepFade / 2)
+	r.sleepTick(NowPlaying{})
+	r.CancelSleep()
+
+	calls, _ := ioutil.ReadFile(log)
+	if strings.Contains(string(calls), "--set-volume") {
+		t.Errorf("Set the volume without knowing what it was:\n%s", calls)
+	}
+	if !strings.Contains(string(calls), "--print-volume") {
+		t.Errorf("Never asked for the volume:\n%s", calls)
+	}
+}
@@ -0,0 +1,195 @@
+package rhythmbox
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Kinds of event sent to anyone listening
+const (
+	EventTrack  = "track"  // The song changed
+	EventState  = "state"  // Played or paused
+	EventVolume = "volume" // Volume changed
+	EventQueue  = "queue"  // We changed the play queue
+	EventOrder  = "order"  // Shuffle or repeat changed
+	EventSleep  = "sleep"  // Sleep timer started, stopped or went off
+)
+
+// How often the watcher asks the client what is going on
+const WatchInterval = 2 * time.Second
+
+var errNotRunning = errors.New("Rhythmbox isn't running")
+
+// Everything about the player that we push out
+type PlayerState struct {
+	NowPlaying  NowPlaying `json:"nowPlaying"`
+	Paused      bool       `json:"paused"`
+	Volume      float64    `json:"volume"`
+	Shuffle     bool       `json:"shuffle"`
+	Repeat      bool       `json:"repeat"`
+	QueueLength int        `json:"queueLength"` // Tracks up next
+	Sleep       SleepTimer `json:"sleep"`
+}
+
+type Event struct {
+	Type  string      `json:"type"`
+	State PlayerState `json:"state"`
+}
+
+// Fans events out to every subscriber. A slow subscriber misses events rather
+// than holding everyone else up.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+func (b *Broker) Subscribe() chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]bool)
+	}
+	c := make(chan Event, 16)
+	b.subscribers[c] = true
+	return c
+}
+
+func (b *Broker) Unsubscribe(c chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers[c] {
+		delete(b.subscribers, c)
+		close(c)
+	}
+}
+
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c := range b.subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// Holds what the watcher last saw
+type watchState struct {
+	mu           sync.Mutex
+	state        PlayerState
+	queueChanged bool
+}
+
+// The last state seen by the watcher
+func (r *Client) State() PlayerState {
+	r.watch.mu.Lock()
+	defer r.watch.mu.Unlock()
+	return r.watch.state
+}
+
+// Let the watcher know we changed the queue, it gets sent out on the next poll
+// so enqueueing a whole album only makes the one event
+func (r *Client) queueChanged() {
+	r.watch.mu.Lock()
+	r.watch.queueChanged = true
+	r.watch.mu.Unlock()
+}
+
+// Remember the play order we set, until the watcher reads it back from the
+// player. Without D-Bus what we set is all we know.
+func (r *Client) setOrder(shuffle, repeat bool) {
+	r.watch.mu.Lock()
+	r.watch.state.Shuffle = shuffle
+	r.watch.state.Repeat = repeat
+	state := r.watch.state
+	r.watch.mu.Unlock()
+
+	r.Events.Publish(Event{Type: EventOrder, State: state})
+}
+
+// Poll the client forever, publishing an event whenever the track, play state,
+// volume or queue changes, and recording each play in the history. If we can't
+// ask Rhythmbox whether it is paused, we guess that it is when the elapsed
+// time stops moving. Nothing the watcher does starts Rhythmbox, once it has
+// been quit it shows as stopped until somebody plays something.
+func (r *Client) Watch(interval time.Duration) {
+	r.loadHistory()
+
+	for {
+		r.poll()
+		time.Sleep(interval)
+	}
+}
+
+func (r *Client) poll() {
+	next := PlayerState{NowPlaying: NowPlaying{Id: -1, AlbumId: -1, known: true}}
+	volume, volumeErr := 0.0, errNotRunning
+	var shuffle, repeat, orderKnown bool
+	if r.Running() {
+		r.topUp()
+		next.NowPlaying = r.NowPlaying()
+		volume, volumeErr = r.Volume()
+		shuffle, repeat, orderKnown = r.PlayOrder()
+	}
+	np := next.NowPlaying
+
+	// A new track means our copy of the queue has moved on
+	if np.HasTrack() && np.Id != r.State().NowPlaying.Id {
+		r.syncQueue(np.Id)
+	}
+	next.QueueLength = r.QueueLength()
+
+	r.sleepTick(np)
+	next.Sleep = r.SleepTimer()
+
+	r.watch.mu.Lock()
+	last := r.watch.state
+	sameTrack := np.Title == last.NowPlaying.Title &&
+		np.Artist == last.NowPlaying.Artist &&
+		np.Album == last.NowPlaying.Album
+	next.Shuffle, next.Repeat = last.Shuffle, last.Repeat
+	if orderKnown {
+		next.Shuffle, next.Repeat = shuffle, repeat
+	}
+	// Keep the last volume we read rather than send out a wrong one
+	next.Volume = last.Volume
+	if volumeErr == nil {
+		next.Volume = volume
+	}
+	if np.known {
+		next.Paused = np.Paused
+	} else {
+		next.Paused = np.Playing && sameTrack && np.Elapsed == last.NowPlaying.Elapsed
+	}
+
+	var events []string
+	if np.HasTrack() != last.NowPlaying.HasTrack() || !sameTrack {
+		events = append(events, EventTrack)
+	}
+	if next.Paused != last.Paused {
+		events = append(events, EventState)
+	}
+	if next.Volume != last.Volume {
+		events = append(events, EventVolume)
+	}
+	if next.Shuffle != last.Shuffle || next.Repeat != last.Repeat {
+		events = append(events, EventOrder)
+	}
+	if r.watch.queueChanged || next.QueueLength != last.QueueLength {
+		events = append(events, EventQueue)
+		r.watch.queueChanged = false
+	}
+	r.watch.state = next
+	r.watch.mu.Unlock()
+
+	r.recordPlay(np, next.Paused)
+
+	for _, e := range events {
+		r.Events.Publish(Event{Type: e, State: next})
+	}
+}
@@ -0,0 +1,127 @@
+package rhythmbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Every command the watcher runs says not to start Rhythmbox, so quitting it
+// sticks. The Auto-DJ is on with an empty queue, so it would like to add some.
+func TestPollNoStart(t *testing.T) {
+	r := testClient(t)
+	log := logClient(t, r)
+	script, _ := ioutil.ReadFile(r.ClientBinary)
+	scriptClient(t, r, strings.TrimPrefix(string(script), "#!/bin/sh\n")+
+		`[ "$2" != "--check-running" ]`)
+	if err := r.StartAutoDJ(AutoDJ{Rule: AutoDJGenre, Seed: 0, MinQueue: 3, Batch: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// Then Rhythmbox was quit
+	r.queueClear()
+	ioutil.WriteFile(log, nil, 0644)
+
+	r.poll()
+	calls, _ := ioutil.ReadFile(log)
+	for _, call := range strings.Split(strings.TrimSpace(string(calls)), "\n") {
+		if !strings.HasPrefix(call, "--no-start ") {
+			t.Errorf("Ran %q while Rhythmbox wasn't running", call)
+		}
+	}
+	if r.QueueLength() != 0 {
+		t.Errorf("The Auto-DJ queued %v tracks with nothing to play them", r.QueueLength())
+	}
+}
+
+func TestPollStopped(t *testing.T) {
+	r := testClient(t)
+	scriptClient(t, r, `[ "$2" = "--check-running" ] && exit 1
+[ "$2" = "--print-volume" ] && echo 'Playback volume is 0.500000.'
+exit 0`)
+	r.watch.state = PlayerState{
+		NowPlaying: NowPlaying{Id: 0, AlbumId: 0, Playing: true, Title: "Zalbum 1"},
+		Volume:     0.5,
+	}
+	events := r.Events.Subscribe()
+
+	r.poll()
+	state := r.State()
+	if state.NowPlaying.HasTrack() || state.Paused || state.NowPlaying.Id != -1 {
+		t.Errorf("Got %+v once Rhythmbox had quit, want stopped", state)
+	}
+	if state.Volume != 0.5 {
+		t.Errorf("Volume is %v, want the last one kept", state.Volume)
+	}
+	sent := false
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventTrack {
+			sent = true
+		}
+	}
+	if !sent {
+		t.Error("Stopping wasn't sent out")
+	}
+}
+
+// Put a gdbus first in the PATH that answers for the player's properties
+func fakeGdbus(t *testing.T, shuffle, loop string) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+for last; do :; done
+case $last in
+Shuffle) echo "(<` + shuffle + `>,)" ;;
+LoopStatus) echo "(<'` + loop + `'>,)" ;;
+*) exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "gdbus"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// Changes made in Rhythmbox's own window are picked up
+func TestPollPlayOrder(t *testing.T) {
+	tests := []struct {
+		shuffle, loop string
+		wantS, wantR  bool
+		fromPlayer    bool
+	}{
+		{"true", "Playlist", true, true, true},
+		{"false", "Track", false, true, true},
+		{"true", "None", true, false, true},
+		{"false", "None", false, false, true},
+		// No D-Bus, so what we set is kept
+		{"", "", true, false, false},
+	}
+
+	for _, tt := range tests {
+		r := testClient(t)
+		logClient(t, r)
+		r.Shuffle()
+		if tt.fromPlayer {
+			fakeGdbus(t, tt.shuffle, tt.loop)
+		} else {
+			t.Setenv("PATH", t.TempDir())
+		}
+		events := r.Events.Subscribe()
+
+		r.poll()
+		state := r.State()
+		if state.Shuffle != tt.wantS || state.Repeat != tt.wantR {
+			t.Errorf("%v %v: got shuffle %v and repeat %v, want %v and %v",
+				tt.shuffle, tt.loop, state.Shuffle, state.Repeat, tt.wantS, tt.wantR)
+		}
+		sent := false
+		for len(events) > 0 {
+			if e := <-events; e.Type == EventOrder {
+				sent = true
+			}
+		}
+		if changed := !tt.wantS || tt.wantR; sent != changed {
+			t.Errorf("%v %v: order event sent %v, want %v", tt.shuffle, tt.loop, sent, changed)
+		}
+	}
+}
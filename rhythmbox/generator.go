@@ -0,0 +1,172 @@
+package rhythmbox
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// How many orders we try when looking for a mix that fits
+const mixAttempts = 20
+
+// Which tracks can go in a mix, empty fields match everything
+type MixFilter struct {
+	Genre     string
+	FromYear  int
+	ToYear    int
+	MinRating int
+	Artists   []string
+}
+
+type MixRequest struct {
+	MixFilter
+	Length     int   // Seconds wanted
+	Tolerance  int   // Seconds either side that are close enough
+	AlbumOrder bool  // Keep tracks from the same album in album order
+	Seed       int64 // 0 picks a new one
+}
+
+type Mix struct {
+	Tracks []Entry
+	Length int // Seconds
+	Seed   int64
+}
+
+func (f MixFilter) match(e Entry) bool {
+	if e.Type != "song" || e.Duration <= 0 {
+		return false
+	}
+	if len(f.Genre) > 0 && !strings.EqualFold(e.Genre, f.Genre) {
+		return false
+	}
+	if f.FromYear > 0 && e.Year() < f.FromYear {
+		return false
+	}
+	if f.ToYear > 0 && (e.Year() == 0 || e.Year() > f.ToYear) {
+		return false
+	}
+	if e.Rating < f.MinRating {
+		return false
+	}
+	if len(f.Artists) > 0 {
+		for _, a := range f.Artists {
+			if strings.EqualFold(strings.TrimSpace(a), e.Artist) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Fill the requested length from the tracks matching the filter, without
+// repeating a track. The same request and seed always give the same mix.
+func (r *Client) GenerateMix(req MixRequest) (Mix, error) {
+	if req.Length <= 0 {
+		return Mix{}, errors.New("How long should the mix be?")
+	}
+	if req.Seed == 0 {
+		req.Seed = NewSeed()
+	}
+
+	var candidates []Entry
+	total := 0
+	for _, e := range r.Db.Entries {
+		if req.match(e) {
+			candidates = append(candidates, e)
+			total += e.Duration
+		}
+	}
+	if len(candidates) == 0 {
+		return Mix{}, errors.New("No tracks match")
+	}
+
+	// Greedily fill from a few different orders and keep the closest
+	rng := rand.New(rand.NewSource(req.Seed))
+	best := Mix{Seed: req.Seed}
+	for i := 0; i < mixAttempts; i++ {
+		rng.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+
+		mix := Mix{Seed: req.Seed}
+		for _, e := range candidates {
+			if mix.Length+e.Duration <= req.Length+req.Tolerance {
+				mix.Tracks = append(mix.Tracks, e)
+				mix.Length += e.Duration
+			}
+			if mix.Length >= req.Length-req.Tolerance {
+				break
+			}
+		}
+
+		if abs(req.Length-mix.Length) < abs(req.Length-best.Length) {
+			best = mix
+		}
+		if mix.Length >= req.Length-req.Tolerance {
+			break
+		}
+	}
+
+	if req.AlbumOrder {
+		best.keepAlbumOrder()
+	}
+
+	if abs(req.Length-best.Length) > req.Tolerance {
+		if total < req.Length {
+			return best, fmt.Errorf("Only %v of music matches", FormatDuration(total))
+		}
+		return best, fmt.Errorf("Could only get within %v", FormatDuration(abs(req.Length-best.Length)))
+	}
+	return best, nil
+}
+
+// Sort each album's tracks by track number, leaving them in the slots the
+// album already has in the mix
+func (m *Mix) keepAlbumOrder() {
+	slots := make(map[string][]int)
+	for i, e := range m.Tracks {
+		slots[e.Album] = append(slots[e.Album], i)
+	}
+
+	for _, positions := range slots {
+		tracks := make([]Entry, len(positions))
+		for i, p := range positions {
+			tracks[i] = m.Tracks[p]
+		}
+		sort.Stable(ByTrackNumber(tracks))
+		for i, p := range positions {
+			m.Tracks[p] = tracks[i]
+		}
+	}
+}
+
+// The mix as an M3U playlist
+func (m Mix) M3U() string {
+	out := "#EXTM3U\n"
+	for _, e := range m.Tracks {
+		out += fmt.Sprintf("#EXTINF:%d,%s - %s\n%s\n", e.Duration, e.Artist, e.Title, e.Location)
+	}
+	return out
+}
+
+func (m Mix) LengthString() string {
+	return FormatDuration(m.Length)
+}
+
+func (r *Client) PlayMix(m Mix) {
+	r.ClearQueue()
+	for _, e := range m.Tracks {
+		r.Enqueue(e.Location)
+	}
+	r.Play()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,119 @@
+package rhythmbox
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Jazz and rock albums of tracks from 2 to 6 minutes long
+func mixClient() *Client {
+	r := &Client{}
+	for a := 0; a < 6; a++ {
+		genre := "Jazz"
+		if a%2 == 1 {
+			genre = "Rock"
+		}
+		for n := 1; n <= 8; n++ {
+			r.Db.Entries = append(r.Db.Entries, Entry{
+				Id:          len(r.Db.Entries),
+				Type:        "song",
+				Title:       fmt.Sprint("Track ", n),
+				Artist:      fmt.Sprint("Artist ", a),
+				Album:       fmt.Sprint("Album ", a),
+				Genre:       genre,
+				TrackNumber: n,
+				Duration:    120 + (a*37+n*53)%240,
+			})
+		}
+	}
+	return r
+}
+
+func TestMixLength(t *testing.T) {
+	r := mixClient()
+	req := MixRequest{MixFilter: MixFilter{Genre: "jazz"}, Length: 45 * 60, Tolerance: 60}
+
+	for seed := int64(1); seed <= 50; seed++ {
+		req.Seed = seed
+		mix, err := r.GenerateMix(req)
+		if err != nil {
+			t.Fatalf("Seed %v: %v", seed, err)
+		}
+		if abs(mix.Length-req.Length) > req.Tolerance {
+			t.Errorf("Seed %v: %v long, want %v", seed, mix.LengthString(), FormatDuration(req.Length))
+		}
+
+		total := 0
+		seen := make(map[int]bool)
+		for _, e := range mix.Tracks {
+			if e.Genre != "Jazz" {
+				t.Errorf("Seed %v: %v is %v", seed, e.Title, e.Genre)
+			}
+			if seen[e.Id] {
+				t.Errorf("Seed %v: %v is in twice", seed, e.Id)
+			}
+			seen[e.Id] = true
+			total += e.Duration
+		}
+		if total != mix.Length {
+			t.Errorf("Seed %v: tracks add up to %v, mix says %v", seed, total, mix.Length)
+		}
+	}
+}
+
+func TestMixSeed(t *testing.T) {
+	r := mixClient()
+	req := MixRequest{Length: 30 * 60, Tolerance: 30, Seed: 7}
+
+	a, errA := r.GenerateMix(req)
+	b, errB := r.GenerateMix(req)
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+	if a.Seed != 7 || trackIds(a.Tracks) != trackIds(b.Tracks) {
+		t.Errorf("Seed 7 gave %v then %v", trackIds(a.Tracks), trackIds(b.Tracks))
+	}
+
+	// Without one a seed is picked, and that gets the same mix again
+	req.Seed = 0
+	c, _ := r.GenerateMix(req)
+	req.Seed = c.Seed
+	d, _ := r.GenerateMix(req)
+	if c.Seed == 0 || trackIds(c.Tracks) != trackIds(d.Tracks) {
+		t.Errorf("Seed %v gave %v then %v", c.Seed, trackIds(c.Tracks), trackIds(d.Tracks))
+	}
+}
+
+func TestMixAlbumOrder(t *testing.T) {
+	r := mixClient()
+	mix, err := r.GenerateMix(MixRequest{Length: 60 * 60, Tolerance: 60, AlbumOrder: true, Seed: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := make(map[string]int)
+	for _, e := range mix.Tracks {
+		if e.TrackNumber < last[e.Album] {
+			t.Errorf("%v track %v after track %v", e.Album, e.TrackNumber, last[e.Album])
+		}
+		last[e.Album] = e.TrackNumber
+	}
+}
+
+func TestMixNotEnough(t *testing.T) {
+	r := mixClient()
+
+	_, err := r.GenerateMix(MixRequest{MixFilter: MixFilter{Artists: []string{"Artist 0"}}, Length: 5 * 60 * 60})
+	if err == nil || !strings.HasPrefix(err.Error(), "Only ") {
+		t.Errorf("Five hours of one album gave %v", err)
+	}
+	_, err = r.GenerateMix(MixRequest{MixFilter: MixFilter{Genre: "Polka"}, Length: 60})
+	if err == nil {
+		t.Error("No polka, but no error either")
+	}
+	_, err = r.GenerateMix(MixRequest{})
+	if err == nil {
+		t.Error("No length, but no error either")
+	}
+}
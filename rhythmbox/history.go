@@ -0,0 +1,211 @@
+package rhythmbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every play is appended to this, one JSON object a line, in the data dir
+const HistoryFile = "history.jsonl"
+
+// Stopping more than this many seconds before the end counts as a skip
+const SkipSlack = 10
+
+// The same track going back to within this many seconds of its start is
+// played again, further in is only seeking back
+const RestartSlack = 10
+
+// One listen to a track. The names are kept as well as the Id so the history
+// still makes sense after the library changes.
+type Play struct {
+	Id       int       `json:"id"`
+	Title    string    `json:"title"`
+	Artist   string    `json:"artist"`
+	Album    string    `json:"album"`
+	Genre    string    `json:"genre"`
+	Started  time.Time `json:"started"`
+	Duration int       `json:"duration"` // Seconds, of the track
+	Listened int       `json:"listened"` // Seconds actually played
+	Skipped  bool      `json:"skipped"`
+}
+
+func (p Play) ListenedString() string {
+	return FormatDuration(p.Listened)
+}
+
+// How plays and library tracks are matched up, the Ids can change
+func TrackKey(artist, title string) string {
+	return artist + " - " + title
+}
+
+// Which plays to show, empty fields match everything
+type HistoryFilter struct {
+	Artist      string
+	Album       string
+	Genre       string
+	From        time.Time
+	To          time.Time
+	SkippedOnly bool
+}
+
+func (f HistoryFilter) match(p Play) bool {
+	if len(f.Artist) > 0 && !strings.Contains(strings.ToLower(p.Artist), strings.ToLower(f.Artist)) {
+		return false
+	}
+	if len(f.Album) > 0 && !strings.Contains(strings.ToLower(p.Album), strings.ToLower(f.Album)) {
+		return false
+	}
+	if len(f.Genre) > 0 && !strings.EqualFold(p.Genre, f.Genre) {
+		return false
+	}
+	if !f.From.IsZero() && p.Started.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !p.Started.Before(f.To) {
+		return false
+	}
+	if f.SkippedOnly && !p.Skipped {
+		return false
+	}
+	return true
+}
+
+type history struct {
+	mu          sync.Mutex
+	plays       []Play
+	current     *Play
+	lastPoll    time.Time
+	lastElapsed int
+}
+
+func (r *Client) historyPath() string {
+	return filepath.Join(r.DataDir, HistoryFile)
+}
+
+// Read the history back in, it is fine if there is none yet
+func (r *Client) loadHistory() {
+	r.history.mu.Lock()
+	defer r.history.mu.Unlock()
+
+	file, err := os.Open(r.historyPath())
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var p Play
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			fmt.Printf("[ERRO] Skipping bad history line: %v\n", err)
+			continue
+		}
+		r.history.plays = append(r.history.plays, p)
+	}
+}
+
+// Call with the lock held
+func (r *Client) appendHistory(p Play) {
+	r.history.plays = append(r.history.plays, p)
+
+	data, err := json.Marshal(p)
+	if err == nil {
+		err = os.MkdirAll(r.DataDir, 0755)
+	}
+	var file *os.File
+	if err == nil {
+		file, err = os.OpenFile(r.historyPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+	if err == nil {
+		_, err = file.Write(append(data, '\n'))
+		file.Close()
+	}
+	if err != nil {
+		fmt.Printf("[ERRO] Could not save play: %v\n", err)
+	}
+}
+
+// Keep track of the current play, called by the watcher on every poll. When
+// the track changes, or the same one starts again, the last one is finished
+// off and saved.
+func (r *Client) recordPlay(np NowPlaying, paused bool) {
+	r.history.mu.Lock()
+	defer r.history.mu.Unlock()
+
+	now := time.Now()
+	current := r.history.current
+
+	if current != nil && !paused {
+		current.Listened += int(now.Sub(r.history.lastPoll).Seconds() + 0.5)
+	}
+	r.history.lastPoll = now
+
+	sameTrack := current != nil && np.HasTrack() && current.Title == np.Title &&
+		current.Artist == np.Artist && current.Album == np.Album
+	// On repeat, or queued twice in a row, only the elapsed time tells
+	restarted := sameTrack && np.Elapsed < r.history.lastElapsed && np.Elapsed <= RestartSlack
+	r.history.lastElapsed = np.Elapsed
+	if sameTrack && !restarted {
+		return
+	}
+
+	if current != nil {
+		if current.Listened > current.Duration && current.Duration > 0 {
+			current.Listened = current.Duration
+		}
+		current.Skipped = current.Duration > 0 && current.Listened < current.Duration-SkipSlack
+		p := *current
+		r.history.current = nil
+		r.appendHistory(p)
+		r.scrobble(p)
+	}
+
+	if np.HasTrack() {
+		r.history.current = &Play{
+			Id:       np.Id,
+			Title:    np.Title,
+			Artist:   np.Artist,
+			Album:    np.Album,
+			Genre:    np.Genre,
+			Started:  now.Add(-time.Duration(np.Elapsed) * time.Second),
+			Duration: np.Duration,
+			Listened: np.Elapsed,
+		}
+		r.scrobbleNowPlaying(*r.history.current)
+	}
+}
+
+// The plays matching the filter, newest first
+func (r *Client) History(f HistoryFilter) []Play {
+	r.history.mu.Lock()
+	defer r.history.mu.Unlock()
+
+	var plays []Play
+	for i := len(r.history.plays) - 1; i >= 0; i-- {
+		if f.match(r.history.plays[i]) {
+			plays = append(plays, r.history.plays[i])
+		}
+	}
+	return plays
+}
+
+// When each track was last played, by TrackKey
+func (r *Client) LastPlayed() map[string]time.Time {
+	r.history.mu.Lock()
+	defer r.history.mu.Unlock()
+
+	last := make(map[string]time.Time)
+	for _, p := range r.history.plays {
+		key := TrackKey(p.Artist, p.Title)
+		if p.Started.After(last[key]) {
+			last[key] = p.Started
+		}
+	}
+	return last
+}
@@ -0,0 +1,42 @@
+package rhythmbox
+
+import "testing"
+
+func playing(title string, elapsed int) NowPlaying {
+	return NowPlaying{Playing: true, Id: -1, Title: title, Artist: "Band", Album: "Record", Duration: 200, Elapsed: elapsed}
+}
+
+// The same track twice in a row is two plays, seeking back isn't
+func TestHistoryRepeats(t *testing.T) {
+	r := &Client{DataDir: t.TempDir()}
+
+	for _, np := range []NowPlaying{
+		playing("Song", 0),
+		playing("Song", 100),
+		playing("Song", 40), // Seeked back
+		playing("Song", 198),
+		playing("Song", 1), // On repeat
+		playing("Song", 150),
+		playing("Other", 2),
+		playing("Other", 3),
+		{Id: -1},
+	} {
+		r.recordPlay(np, false)
+	}
+
+	plays := r.History(HistoryFilter{})
+	var titles []string
+	for i := len(plays) - 1; i >= 0; i-- {
+		titles = append(titles, plays[i].Title)
+	}
+	if len(titles) != 3 || titles[0] != "Song" || titles[1] != "Song" || titles[2] != "Other" {
+		t.Errorf("Recorded %v, want [Song Song Other]", titles)
+	}
+
+	// And they are read back in the same
+	again := &Client{DataDir: r.DataDir}
+	again.loadHistory()
+	if n := len(again.History(HistoryFilter{})); n != 3 {
+		t.Errorf("Read back %v plays, want 3", n)
+	}
+}
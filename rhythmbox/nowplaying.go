@@ -0,0 +1,136 @@
+package rhythmbox
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Everything the client can tell us about the current song, plus what we can
+// match up from the library
+type NowPlaying struct {
+	Playing         bool   `json:"playing"` // Not when paused
+	Paused          bool   `json:"paused"`
+	Id              int    `json:"id"` // Library entry, -1 if not in the library
+	Album           string `json:"album"`
+	AlbumArtist     string `json:"albumArtist"`
+	AlbumArtistSort string `json:"albumArtistSort"`
+	Artist          string `json:"artist"`
+	ArtistSort      string `json:"artistSort"`
+	Title           string `json:"title"`
+	StreamTitle     string `json:"streamTitle"`
+	TrackNumber     int    `json:"trackNumber"`
+	Disc            int    `json:"disc"`
+	Year            int    `json:"year"`
+	Genre           string `json:"genre"`
+	Duration        int    `json:"duration"` // Seconds
+	Elapsed         int    `json:"elapsed"`  // Seconds
+	Rating          int    `json:"rating"`   // From the library
+	Image           string `json:"image"`
+	HasImage        bool   `json:"hasImage"`
+	AlbumId         int    `json:"albumId"` // -1 if not in the library
+
+	// Whether Playing and Paused came from the player, or are a guess
+	known bool
+}
+
+// Whether there is a track, playing or paused
+func (np NowPlaying) HasTrack() bool {
+	return np.Playing || np.Paused
+}
+
+// Separates the fields when asking for everything in one go, so we only have
+// to run the client once
+const nowPlayingSeparator = "\x1f"
+
+// The format codes, in the order they are unpacked below
+var nowPlayingCodes = []string{
+	"%at", "%aa", "%as", "%ay", "%ag", "%an",
+	"%st", "%tn", "%tt", "%ta", "%ts", "%td", "%te",
+}
+
+// Get the details of the current song
+func (r *Client) NowPlaying() NowPlaying {
+	np := NowPlaying{Id: -1, AlbumId: -1}
+
+	out := r.PrintPlayingFormat(strings.Join(nowPlayingCodes, nowPlayingSeparator))
+	fields := strings.Split(strings.TrimRight(out, "\n"), nowPlayingSeparator)
+	if len(fields) != len(nowPlayingCodes) {
+		// "Not playing" or an error from the client
+		return np
+	}
+
+	switch r.PlaybackStatus() {
+	case "Playing":
+		np.Playing, np.known = true, true
+	case "Paused":
+		np.Paused, np.known = true, true
+	case "Stopped":
+		return NowPlaying{Id: -1, AlbumId: -1, known: true}
+	default:
+		// No D-Bus, so the watcher has to guess
+		np.Playing = true
+	}
+	np.Album = fields[0]
+	np.AlbumArtist = fields[1]
+	np.AlbumArtistSort = fields[2]
+	np.Year, _ = strconv.Atoi(fields[3])
+	np.Genre = fields[4]
+	np.Disc, _ = strconv.Atoi(fields[5])
+	np.StreamTitle = fields[6]
+	np.TrackNumber, _ = strconv.Atoi(fields[7])
+	np.Title = fields[8]
+	np.Artist = fields[9]
+	np.ArtistSort = fields[10]
+	np.Duration = ParseDuration(fields[11])
+	np.Elapsed = ParseDuration(fields[12])
+
+	// Match it up with the library, from the maps made by Setup
+	if id, ok := r.tracks[[3]string{np.Title, np.Artist, np.Album}]; ok {
+		np.Id = id
+		np.Rating = r.Db.Entries[id].Rating
+	}
+	if np.Id >= 0 && len(np.Album) > 0 {
+		// Albums can share a name, so go by the track's own. Any track's Id
+		// will do for the album if it isn't the one it is listed under.
+		np.AlbumId = np.Id
+		if id, ok := r.albumIds[[2]string{np.Album, np.Artist}]; ok {
+			np.AlbumId = id
+		}
+		np.Image, np.HasImage = AlbumArtURL(np.AlbumId), r.HasAlbumArt(np.AlbumId)
+	}
+
+	return np
+}
+
+// rhythmbox-client can't tell us if it is paused, so ask Rhythmbox over MPRIS.
+// Playing, Paused or Stopped, or empty if there is no D-Bus to ask.
+func (r *Client) PlaybackStatus() string {
+	return mprisProperty("PlaybackStatus")
+}
+
+// Nor can it tell us the play order, which can be changed in Rhythmbox's own
+// window. ok is false if there is no D-Bus to ask.
+func (r *Client) PlayOrder() (shuffle, repeat, ok bool) {
+	s, loop := mprisProperty("Shuffle"), mprisProperty("LoopStatus")
+	if (s != "true" && s != "false") || len(loop) == 0 {
+		return false, false, false
+	}
+	// LoopStatus is None, Track or Playlist
+	return s == "true", loop != "None", true
+}
+
+// A property of Rhythmbox's org.mpris.MediaPlayer2.Player, or empty if it
+// can't be read
+func mprisProperty(name string) string {
+	out, err := exec.Command("gdbus", "call", "--session",
+		"--dest", "org.mpris.MediaPlayer2.rhythmbox",
+		"--object-path", "/org/mpris/MediaPlayer2",
+		"--method", "org.freedesktop.DBus.Properties.Get",
+		"org.mpris.MediaPlayer2.Player", name).Output()
+	if err != nil {
+		return ""
+	}
+	// Comes back as (<'Playing'>,) or (<true>,)
+	return strings.Trim(strings.TrimSpace(string(out)), "()<>,'")
+}
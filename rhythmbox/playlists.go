@@ -0,0 +1,75 @@
+package rhythmbox
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Rhythmbox keeps playlists next to the library
+const RhythmboxXmlPlaylists = "playlists.xml"
+
+/*
+<rhythmdb-playlists>
+  <playlist name="Party" show-browser="false" browser-position="180" search-type="search-match" type="static">
+    <location>file:///home/ae/Music/progressive_psy/Kaempfer%20&amp;%20Dietze%20-%20Timeline.mp3</location>
+  </playlist>
+*/
+
+type RhythmdbPlaylists struct {
+	XMLName   xml.Name   `xml:"rhythmdb-playlists"`
+	Playlists []Playlist `xml:"playlist"`
+}
+
+type Playlist struct {
+	Id        int
+	Name      string   `xml:"name,attr"`
+	Type      string   `xml:"type,attr"` // Only "static" playlists list their tracks
+	Locations []string `xml:"location"`
+}
+
+// Read in the static playlists, it is fine if there are none
+func (r *Client) loadPlaylists() {
+	file, err := ioutil.ReadFile(filepath.Join(filepath.Dir(r.Library), RhythmboxXmlPlaylists))
+	if err != nil {
+		return
+	}
+
+	var db RhythmdbPlaylists
+	err = xml.Unmarshal(file, &db)
+	if err != nil {
+		fmt.Printf("[ERRO] Could not load playlists: %v\n", err)
+		return
+	}
+
+	for _, p := range db.Playlists {
+		if p.Type == "static" && len(p.Locations) > 0 {
+			p.Id = len(r.Playlists)
+			r.Playlists = append(r.Playlists, p)
+		}
+	}
+}
+
+// The tracks of a playlist that are in the library, in playlist order
+func (r *Client) GetPlaylistTracks(id int) []Entry {
+	var tracks []Entry
+	if id < 0 || id >= len(r.Playlists) {
+		return tracks
+	}
+
+	for _, l := range r.Playlists[id].Locations {
+		if e, ok := r.locations[l]; ok {
+			tracks = append(tracks, r.Db.Entries[e])
+		}
+	}
+	return tracks
+}
+
+func (r *Client) PlayPlaylist(id int) {
+	r.ClearQueue()
+	for _, e := range r.GetPlaylistTracks(id) {
+		r.Enqueue(e.Location)
+	}
+	r.Play()
+}
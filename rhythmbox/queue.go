@@ -0,0 +1,133 @@
+package rhythmbox
+
+import "sync"
+
+// Our copy of the Rhythmbox play queue. The client can only clear the queue
+// and add to it, so we remember everything we put in and rebuild the real one
+// whenever it needs to change.
+type queue struct {
+	mu      sync.Mutex
+	entries []int // Ids of the tracks still to play, in order
+
+	// Held across the client calls that change the real queue, so a rebuild
+	// can't have another's clear or enqueues land in the middle of it
+	ops sync.Mutex
+}
+
+// The tracks waiting to be played
+func (r *Client) UpNext() []Entry {
+	r.queue.mu.Lock()
+	defer r.queue.mu.Unlock()
+
+	entries := make([]Entry, len(r.queue.entries))
+	for i, id := range r.queue.entries {
+		entries[i] = r.Db.Entries[id]
+	}
+	return entries
+}
+
+// Number of tracks waiting to be played
+func (r *Client) QueueLength() int {
+	r.queue.mu.Lock()
+	defer r.queue.mu.Unlock()
+	return len(r.queue.entries)
+}
+
+// Take the track at the given position out of the queue
+func (r *Client) RemoveFromQueue(position int) {
+	r.queue.ops.Lock()
+	defer r.queue.ops.Unlock()
+
+	r.queue.mu.Lock()
+	if position < 0 || position >= len(r.queue.entries) {
+		r.queue.mu.Unlock()
+		return
+	}
+	r.queue.entries = append(r.queue.entries[:position], r.queue.entries[position+1:]...)
+	r.queue.mu.Unlock()
+
+	r.rebuildQueue()
+}
+
+// Move the track at one position in the queue to another
+func (r *Client) MoveInQueue(from, to int) {
+	r.queue.ops.Lock()
+	defer r.queue.ops.Unlock()
+
+	r.queue.mu.Lock()
+	n := len(r.queue.entries)
+	if from < 0 || from >= n || to < 0 || to >= n || from == to {
+		r.queue.mu.Unlock()
+		return
+	}
+	id := r.queue.entries[from]
+	r.queue.entries = append(r.queue.entries[:from], r.queue.entries[from+1:]...)
+	r.queue.entries = append(r.queue.entries[:to], append([]int{id}, r.queue.entries[to:]...)...)
+	r.queue.mu.Unlock()
+
+	r.rebuildQueue()
+}
+
+// Put a track at the front of the queue, so it plays after the current one
+func (r *Client) PlayNext(id int) {
+	if id < 0 || id >= len(r.Db.Entries) {
+		return
+	}
+
+	r.queue.ops.Lock()
+	defer r.queue.ops.Unlock()
+
+	r.queue.mu.Lock()
+	r.queue.entries = append([]int{id}, r.queue.entries...)
+	r.queue.mu.Unlock()
+
+	r.rebuildQueue()
+}
+
+// Clear the real queue and fill it back up from our copy. Call with the ops
+// lock held.
+func (r *Client) rebuildQueue() {
+	r.queue.mu.Lock()
+	ids := make([]int, len(r.queue.entries))
+	copy(ids, r.queue.entries)
+	r.queue.mu.Unlock()
+
+	r.Execute("--clear-queue")
+	for _, id := range ids {
+		r.Execute("--enqueue", r.Db.Entries[id].Location)
+	}
+	r.queueChanged()
+}
+
+// Remember a track we have added to the real queue
+func (r *Client) queueAppend(location string) {
+	id, ok := r.locations[location]
+	if !ok {
+		return
+	}
+
+	r.queue.mu.Lock()
+	r.queue.entries = append(r.queue.entries, id)
+	r.queue.mu.Unlock()
+}
+
+func (r *Client) queueClear() {
+	r.queue.mu.Lock()
+	r.queue.entries = nil
+	r.queue.mu.Unlock()
+}
+
+// The current track changed, so drop it and everything before it from our
+// copy of the queue. If it is not in the queue we leave things alone, it was
+// probably started from Rhythmbox itself.
+func (r *Client) syncQueue(id int) {
+	r.queue.mu.Lock()
+	defer r.queue.mu.Unlock()
+
+	for i, e := range r.queue.entries {
+		if e == id {
+			r.queue.entries = r.queue.entries[i+1:]
+			return
+		}
+	}
+}
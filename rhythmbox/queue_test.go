@@ -0,0 +1,66 @@
+package rhythmbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Point the client at a script that writes down everything it is asked to do
+func logClient(t *testing.T, r *Client) string {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	script := filepath.Join(dir, "client")
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+log+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ClientBinary = script
+	return log
+}
+
+// What the real queue holds after the logged commands, run with -race
+func TestQueueMatchesClient(t *testing.T) {
+	r := testClient(t)
+	log := logClient(t, r)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				e := r.Db.Entries[(i+n)%len(r.Db.Entries)]
+				r.Enqueue(e.Location)
+				r.PlayNext(e.Id)
+				r.MoveInQueue(0, r.QueueLength()-1)
+				r.RemoveFromQueue(i % 3)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var real []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		switch {
+		case line == "--clear-queue":
+			real = nil
+		case strings.HasPrefix(line, "--enqueue "):
+			real = append(real, strings.TrimPrefix(line, "--enqueue "))
+		}
+	}
+
+	var ours []string
+	for _, e := range r.UpNext() {
+		ours = append(ours, e.Location)
+	}
+	if strings.Join(real, "\n") != strings.Join(ours, "\n") {
+		t.Errorf("Rhythmbox has\n%v\nwe have\n%v", real, ours)
+	}
+}
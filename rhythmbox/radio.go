@@ -0,0 +1,233 @@
+package rhythmbox
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// What a radio station can be started from
+const (
+	RadioTrack  = "track"
+	RadioAlbum  = "album"
+	RadioArtist = "artist"
+)
+
+// How much each kind of likeness counts towards a track's score. Each part
+// scores from 0 to 1 before it is weighted.
+type RadioWeights struct {
+	Genre    float64 // Shares a genre with the seed tracks
+	Artist   float64 // By a seed artist, or one they share albums or playlists with
+	Year     float64 // Came out close to the seed tracks
+	BPM      float64 // Close in tempo, when both have a BPM
+	YearSpan float64 // Years apart before the year part drops to 0
+	BPMSpan  float64 // Beats per minute apart before the BPM part drops to 0
+	Pool     int     // How many of the best tracks the station plays from
+}
+
+var DefaultRadioWeights = RadioWeights{
+	Genre:    3,
+	Artist:   2,
+	Year:     1,
+	BPM:      1,
+	YearSpan: 10,
+	BPMSpan:  30,
+	Pool:     100,
+}
+
+// Weights that can make a station, some of them have to count for something
+func (w RadioWeights) check() error {
+	if w.Genre < 0 || w.Artist < 0 || w.Year < 0 || w.BPM < 0 || w.YearSpan < 0 || w.BPMSpan < 0 {
+		return errors.New("Radio weights can't be negative")
+	}
+	if w.Genre+w.Artist+w.Year+w.BPM == 0 {
+		return errors.New("Radio weights are all 0")
+	}
+	if w.Pool <= 0 {
+		return errors.New("The radio needs a pool of at least one track")
+	}
+	return nil
+}
+
+// A candidate track and how it scored, kept in parts for the debug view
+type RadioScore struct {
+	Entry  Entry
+	Score  float64
+	Genre  float64
+	Artist float64
+	Year   float64
+	BPM    float64
+}
+
+type ByScore []RadioScore
+
+func (a ByScore) Len() int           { return len(a) }
+func (a ByScore) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByScore) Less(i, j int) bool { return a[i].Score > a[j].Score }
+
+// The tracks a station is started from
+func (r *Client) radioSeeds(kind string, id int) ([]Entry, error) {
+	switch kind {
+	case RadioTrack:
+		e, err := r.GetTrack(id)
+		return []Entry{e}, err
+	case RadioAlbum:
+		a, err := r.GetAlbum(id)
+		return a.Tracks, err
+	case RadioArtist:
+		a, err := r.GetArtistsTracks(id)
+		return a.Tracks, err
+	}
+	return nil, errors.New("Unknown radio seed: " + kind)
+}
+
+// How often each pair of artists turns up together on an album or playlist
+func (r *Client) artistLinks() map[string]map[string]int {
+	links := make(map[string]map[string]int)
+	link := func(tracks []Entry) {
+		artists := make(map[string]bool)
+		for _, e := range tracks {
+			if len(e.Artist) > 0 {
+				artists[e.Artist] = true
+			}
+		}
+		for a := range artists {
+			for b := range artists {
+				if a == b {
+					continue
+				}
+				if links[a] == nil {
+					links[a] = make(map[string]int)
+				}
+				links[a][b]++
+			}
+		}
+	}
+
+	albums := make(map[string][]Entry)
+	for _, e := range r.Db.Entries {
+		if len(e.Album) > 0 {
+			albums[e.Album] = append(albums[e.Album], e)
+		}
+	}
+	for _, tracks := range albums {
+		link(tracks)
+	}
+	for i := range r.Playlists {
+		link(r.GetPlaylistTracks(i))
+	}
+
+	return links
+}
+
+// Score every song in the library against the seed, best first
+func (r *Client) RadioScores(kind string, id int) ([]RadioScore, error) {
+	seeds, err := r.radioSeeds(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	w := r.RadioWeights
+
+	// Sum up the seed tracks
+	genres := make(map[string]float64)
+	artists := make(map[string]bool)
+	years, bpms := 0.0, 0.0
+	nYears, nBpms := 0, 0
+	for _, e := range seeds {
+		genres[e.Genre]++
+		artists[e.Artist] = true
+		if e.Year() > 0 {
+			years += float64(e.Year())
+			nYears++
+		}
+		if e.BPM > 0 {
+			bpms += e.BPM
+			nBpms++
+		}
+	}
+	for g := range genres {
+		genres[g] /= float64(len(seeds))
+	}
+	delete(genres, "Unknown")
+	if nYears > 0 {
+		years /= float64(nYears)
+	}
+	if nBpms > 0 {
+		bpms /= float64(nBpms)
+	}
+
+	links := r.artistLinks()
+
+	var scores []RadioScore
+	for _, e := range r.Db.Entries {
+		if e.Type != "song" {
+			continue
+		}
+
+		s := RadioScore{Entry: e, Genre: genres[e.Genre]}
+		if artists[e.Artist] {
+			s.Artist = 1
+		} else {
+			shared := 0
+			for a := range artists {
+				shared += links[a][e.Artist]
+			}
+			// A couple of shared albums or playlists is a strong hint
+			s.Artist = math.Min(1, float64(shared)/3)
+		}
+		if nYears > 0 && e.Year() > 0 {
+			s.Year = math.Max(0, 1-math.Abs(float64(e.Year())-years)/w.YearSpan)
+		}
+		if nBpms > 0 && e.BPM > 0 {
+			s.BPM = math.Max(0, 1-math.Abs(e.BPM-bpms)/w.BPMSpan)
+		}
+		s.Score = w.Genre*s.Genre + w.Artist*s.Artist + w.Year*s.Year + w.BPM*s.BPM
+
+		if s.Score > 0 {
+			scores = append(scores, s)
+		}
+	}
+
+	sort.Stable(ByScore(scores))
+	return scores, nil
+}
+
+// The tracks a station plays from
+func (r *Client) radioPool(kind string, id int) []Entry {
+	scores, err := r.RadioScores(kind, id)
+	if err != nil {
+		return nil
+	}
+
+	if len(scores) > r.RadioWeights.Pool {
+		scores = scores[:r.RadioWeights.Pool]
+	}
+	tracks := make([]Entry, len(scores))
+	for i, s := range scores {
+		tracks[i] = s.Entry
+	}
+	return tracks
+}
+
+// Start an endless station from a track, album or artist. The Auto-DJ does the
+// work, keeping the queue topped up from the best scoring tracks.
+func (r *Client) StartRadio(kind string, id int) error {
+	settings, pool, err := r.prepareAutoDJ(AutoDJ{
+		Rule:      AutoDJRadio,
+		RadioSeed: kind,
+		Seed:      id,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only once we know the station can start, a bad one leaves the queue be
+	r.ClearQueue()
+	r.runAutoDJ(settings, pool)
+
+	// Don't wait for the current track to finish
+	if r.State().NowPlaying.HasTrack() {
+		r.Next()
+	}
+	return nil
+}
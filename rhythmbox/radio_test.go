@@ -0,0 +1,63 @@
+package rhythmbox
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// A station that can't start leaves what was queued alone
+func TestStartRadioKeepsQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		id      int
+		weights RadioWeights
+	}{
+		{"unknown kind", "mood", 0, DefaultRadioWeights},
+		{"no such track", RadioTrack, 999, DefaultRadioWeights},
+		{"no such album", RadioAlbum, -1, DefaultRadioWeights},
+		{"weights all 0", RadioTrack, 0, RadioWeights{Pool: 10}},
+		{"negative weight", RadioTrack, 0, RadioWeights{Genre: -1, Artist: 2, Pool: 10}},
+		{"no pool", RadioTrack, 0, RadioWeights{Genre: 1}},
+	}
+
+	for _, tt := range tests {
+		r := testClient(t)
+		log := logClient(t, r)
+		r.RadioWeights = tt.weights
+		r.Enqueue(r.Db.Entries[3].Location)
+		r.Enqueue(r.Db.Entries[4].Location)
+
+		if err := r.StartRadio(tt.kind, tt.id); err == nil {
+			t.Errorf("%v: no error", tt.name)
+		}
+		if n := r.QueueLength(); n != 2 {
+			t.Errorf("%v: %v tracks queued, want the 2 from before", tt.name, n)
+		}
+		calls, _ := ioutil.ReadFile(log)
+		if strings.Contains(string(calls), "--clear-queue") {
+			t.Errorf("%v: the queue was cleared", tt.name)
+		}
+		if r.AutoDJ().Running {
+			t.Errorf("%v: the Auto-DJ is running", tt.name)
+		}
+	}
+}
+
+func TestStartRadio(t *testing.T) {
+	r := testClient(t)
+	log := logClient(t, r)
+	r.Enqueue(r.Db.Entries[3].Location)
+
+	if err := r.StartRadio(RadioArtist, 0); err != nil {
+		t.Fatal(err)
+	}
+	calls, _ := ioutil.ReadFile(log)
+	if !strings.Contains(string(calls), "--clear-queue") {
+		t.Error("The old queue wasn't cleared")
+	}
+	if !r.AutoDJ().Running || r.QueueLength() == 0 {
+		t.Errorf("Not started, %+v with %v queued", r.AutoDJ(), r.QueueLength())
+	}
+}
@@ -3,11 +3,8 @@ package rhythmbox
 import (
 	"encoding/xml"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
-	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
@@ -15,20 +12,55 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// The library (Db, Artists, Albums, Genres and Playlists) is read in by Setup
+// and never changed after that, so requests can share it, and what the getters
+// hand out is copied so changing it can't change the library. Everything else
+// that changes has its own lock.
 type Client struct {
-	Library string
-	Db      Rhythmdb
-	Artists []Item
-	Albums  []Item
-	Genres  []Item
+	Library      string
+	DataDir      string   // Where we keep our own things, like schedules
+	ClientBinary string   // RhythmboxClient unless changed
+	ArtDir       string   // Where album art is copied to, see AlbumArt
+	ArtPatterns  []string // DefaultArtPatterns unless changed
+	ArtIgnore    []string // DefaultArtIgnore unless changed
+	Db           Rhythmdb
+	Artists      []Item
+	Albums       []Item
+	Genres       []Item
+	Playlists    []Playlist
+	Events       Broker // Player events, sent out by Watch
+
+	// Used by the smart shuffle, DefaultSmartWeights unless changed
+	SmartWeights SmartWeights
+	// Used by the radio, DefaultRadioWeights unless changed
+	RadioWeights RadioWeights
+	// Plays are still kept in the history, just not sent anywhere
+	DisableScrobbling bool
+
+	watch     watchState
+	queue     queue
+	autoDJ    autoDJState
+	sleep     sleepState
+	schedules schedules
+	history   history
+	scrobbles scrobbles
+	art       artCache
+	order     sync.Mutex        // Held while changing shuffle or repeat
+	locations map[string]int    // Entry Ids by location
+	tracks    map[[3]string]int // Entry Ids by title, artist and album
+	albumIds  map[[2]string]int // Album Ids by name and artist
 }
 
 const (
-	RhythmboxClient     = "rhythmbox-client"                          // The actual client to run commands through
-	RhythmboxXmlLibrary = "$HOME/.local/share/rhythmbox/rhythmdb.xml" // Do not write to this
+	RhythmboxClient     = "rhythmbox-client"       // The actual client to run commands through
+	RhythmboxXmlLibrary = "rhythmbox/rhythmdb.xml" // In the data home, do not write to this
+	GorhythmboxDataDir  = "gorhythmbox"            // In the data home, ours to write to
+	GorhythmboxCacheDir = "gorhythmbox"            // In the cache home, can be thrown away
+	GorhythmboxArtDir   = "gorhythmbox/art"        // In the cache home too
 )
 
 /*
@@ -75,15 +107,16 @@ type Entry struct {
 	TrackNumber int    `xml:"track-number"`
 	Rating      int    `xml:"rating"`
 	PlayCount   int    `xml:"play-count"`
+	LastPlayed  int    `xml:"last-played"`
 	// FileSize string `xml:"file-size"`
 	Location string `xml:"location"`
 	// Mtime string `xml:"mtime"`
 	FirstSeen int `xml:"first-seen"`
 	LastSeen  int `xml:"last-seen"`
 	// Bitrate string `xml:"bitrate"`
-	// Date string `xml:"date"`
-	MediaType string `xml:"media-type"`
-	Selected  bool
+	Date      int     `xml:"date"` // Julian day, 1 is 1 Jan year 1
+	BPM       float64 `xml:"beats-per-minute"`
+	MediaType string  `xml:"media-type"`
 }
 
 type Item struct {
@@ -98,18 +131,20 @@ type Item struct {
 	Tracks   []Entry
 }
 
-func (i *Item) SelectTrack(trackid int) {
-	for j, t := range i.Tracks {
-		if t.Id == trackid {
-			i.Tracks[j].Selected = true
-			return
-		}
+// The year the track came out, 0 if we don't know
+func (e Entry) Year() int {
+	if e.Date <= 0 {
+		return 0
 	}
+	return time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, e.Date-1).Year()
+}
+
+func (e Entry) DurationString() string {
+	return FormatDuration(e.Duration)
 }
 
 // Sorters
 type ByTrackNumber []Entry
-type ByRandom []Entry
 type ByArtistE []Entry
 type ByArtist []Item
 type ByAlbum []Item
@@ -119,10 +154,6 @@ func (a ByTrackNumber) Len() int           { return len(a) }
 func (a ByTrackNumber) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByTrackNumber) Less(i, j int) bool { return a[i].TrackNumber < a[j].TrackNumber }
 
-func (a ByRandom) Len() int           { return len(a) }
-func (a ByRandom) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByRandom) Less(i, j int) bool { return RandBool() }
-
 func (a ByArtist) Len() int           { return len(a) }
 func (a ByArtist) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByArtist) Less(i, j int) bool { return a[i].Entry.Artist < a[j].Entry.Artist }
@@ -141,6 +172,20 @@ func (a ByGenre) Less(i, j int) bool { return a[i].Entry.Genre < a[j].Entry.Genr
 
 // Read in the library and set everything up for browsing
 func (r *Client) Setup() {
+	if r.SmartWeights == (SmartWeights{}) {
+		r.SmartWeights = DefaultSmartWeights
+	}
+	if r.RadioWeights == (RadioWeights{}) {
+		r.RadioWeights = DefaultRadioWeights
+	}
+	if len(r.ArtDir) == 0 {
+		r.ArtDir = filepath.Join(CacheHome(), GorhythmboxArtDir)
+	}
+	err := os.MkdirAll(r.ArtDir, 0755)
+	if err != nil {
+		fmt.Printf("[ERRO] Could not make the art dir: %v\n", err)
+	}
+
 	file, err := ioutil.ReadFile(r.Library)
 	if err != nil {
 		fmt.Printf("[ERRO] Could not load library: %v\n", err)
@@ -154,10 +199,22 @@ func (r *Client) Setup() {
 	}
 
 	// Add Id
+	r.locations = make(map[string]int)
+	r.tracks = make(map[[3]string]int)
 	for i := 0; i < len(r.Db.Entries); i++ {
-		r.Db.Entries[i].Id = i
+		e := &r.Db.Entries[i]
+		e.Id = i
+		r.locations[e.Location] = i
+		key := [3]string{e.Title, e.Artist, e.Album}
+		if _, ok := r.tracks[key]; !ok {
+			r.tracks[key] = i
+		}
 	}
 
+	r.loadPlaylists()
+	r.loadScrobbles()
+	r.loadSchedules()
+
 	// Sort out the unique artists, albums and genres
 	for _, e := range r.Db.Entries {
 		if len(e.Album) > 0 {
@@ -169,8 +226,8 @@ func (r *Client) Setup() {
 					Entry:    e,
 					HasGenre: e.Genre != "Unknown",
 				}
-				// Try and get a pic
-				item.Image, item.HasImage = r.GetAlbumImage(e.Id)
+				// The art itself is found when it is first asked for
+				item.Image = AlbumArtURL(e.Id)
 
 				r.Albums = append(r.Albums, item)
 			}
@@ -207,6 +264,17 @@ func (r *Client) Setup() {
 			}
 		}
 	}
+
+	// Sorted once here, requests only ever read them
+	sort.Sort(ByArtist(r.Albums))
+	sort.Sort(ByArtist(r.Artists))
+	sort.Sort(ByGenre(r.Genres))
+
+	// So now playing can find the album without looking through them all
+	r.albumIds = make(map[[2]string]int)
+	for _, a := range r.Albums {
+		r.albumIds[[2]string{a.Name, a.Entry.Artist}] = a.Id
+	}
 }
 
 func (r *Client) IncrementGenreCount(s string) {
@@ -252,24 +320,61 @@ func (r *Client) GenreExists(s string) bool {
 	return false
 }
 
+// These hand out copies, so callers can sort or change them without upsetting
+// anyone else
 func (r *Client) GetAlbums() []Item {
-	sort.Sort(ByArtist(r.Albums))
-	return r.Albums
+	return copyItems(r.Albums)
 }
 
 func (r *Client) GetArtists() []Item {
-	sort.Sort(ByArtist(r.Artists))
-	return r.Artists
+	return copyItems(r.Artists)
 }
 
 func (r *Client) GetGenres() []Item {
-	sort.Sort(ByGenre(r.Genres))
-	return r.Genres
+	return copyItems(r.Genres)
+}
+
+// Tracks too, a copy of the items alone would still share those
+func copyItems(items []Item) []Item {
+	c := make([]Item, len(items))
+	copy(c, items)
+	for i := range c {
+		if c[i].Tracks != nil {
+			c[i].Tracks = append([]Entry{}, c[i].Tracks...)
+		}
+	}
+	return c
+}
+
+// Returned when an Id doesn't match anything in the library
+type NotFoundError struct {
+	Kind string
+	Id   int
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("No %v with id %d", e.Kind, e.Id)
+}
+
+func IsNotFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
 }
 
-func (r *Client) GetAlbum(id int) Item {
+func (r *Client) GetTrack(id int) (Entry, error) {
+	if id < 0 || id >= len(r.Db.Entries) {
+		return Entry{}, NotFoundError{"track", id}
+	}
+	return r.Db.Entries[id], nil
+}
+
+func (r *Client) GetAlbum(id int) (Item, error) {
 	album := Item{}
-	albumName := r.Db.Entries[id].Album
+	e, err := r.GetTrack(id)
+	if err != nil || len(e.Album) == 0 {
+		return album, NotFoundError{"album", id}
+	}
+	albumName := e.Album
 
 	for _, a := range r.Db.Entries {
 		if a.Album == albumName {
@@ -281,72 +386,19 @@ func (r *Client) GetAlbum(id int) Item {
 	}
 
 	// Try and get a pic
-	album.Image, album.HasImage = r.GetAlbumImage(id)
+	album.Image, album.HasImage = AlbumArtURL(id), r.HasAlbumArt(id)
 	album.HasGenre = album.Entry.Genre != "Unknown"
 
 	sort.Sort(ByTrackNumber(album.Tracks))
-	return album
-}
-
-// Try and get a pic
-func (r *Client) GetAlbumImage(id int) (image string, hasImage bool) {
-	// Get the first image in the dir if there is one
-	location := r.Db.Entries[id].Location
-	strId := strconv.Itoa(id)
-	imagePath := "/albums/a" + strId + ".jpg"
-
-	// // Check if already exists
-	// if _, err := os.Stat("public" + imagePath); err == nil {
-	// 	// File already exists
-	// 	image = imagePath
-	// 	hasImage = true
-	// 	return
-	// }
-
-	// Remove the bits we dont want
-	location = strings.TrimLeft(location, "file:/")
-	lastSlash := strings.LastIndex(location, "/")
-	location = location[:lastSlash+1]
-	// fmt.Println(html.UnescapeString(location))
-
-	e, _ := url.QueryUnescape(location)
-
-	filepath.Walk("/"+e, func(path string, _ os.FileInfo, _ error) error {
-
-		lastFour := path[len(path)-4:]
-		if lastFour == ".jpg" || lastFour == "jpeg" || lastFour == ".png" {
-			Copy("public/albums/a"+strId+".jpg", path)
-			image = imagePath
-			hasImage = true
-			return nil
-		}
-		return nil
-	})
-
-	return
+	return album, nil
 }
 
-func Copy(dst, src string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-	out, err := os.Create(dst)
+func (r *Client) GetArtistsAlbums(id int) ([]Item, error) {
+	e, err := r.GetArtist(id)
 	if err != nil {
-		return err
-	}
-	defer out.Close()
-	_, err = io.Copy(out, in)
-	cerr := out.Close()
-	if err != nil {
-		return err
+		return nil, err
 	}
-	return cerr
-}
-
-func (r *Client) GetArtistsAlbums(id int) []Item {
-	artist := r.Db.Entries[id].Artist
+	artist := e.Artist
 	albums := Albums{}
 
 	// Get the first
@@ -358,12 +410,16 @@ func (r *Client) GetArtistsAlbums(id int) []Item {
 
 	}
 
-	return albums.Items
+	return copyItems(albums.Items), nil
 }
 
-func (r *Client) GetArtistsTracks(id int) Item {
-	artist := r.Db.Entries[id].Artist
+func (r *Client) GetArtistsTracks(id int) (Item, error) {
 	album := Item{}
+	e, err := r.GetArtist(id)
+	if err != nil {
+		return album, err
+	}
+	artist := e.Artist
 
 	// Get the first
 	for _, a := range r.Db.Entries {
@@ -374,11 +430,15 @@ func (r *Client) GetArtistsTracks(id int) Item {
 
 	}
 
-	return album
+	return album, nil
 }
 
-func (r *Client) GetGenreTracks(id int) Item {
-	genre := r.Db.Entries[id].Genre
+func (r *Client) GetGenreTracks(id int) (Item, error) {
+	e, err := r.GetTrack(id)
+	if err != nil || len(e.Genre) == 0 {
+		return Item{}, NotFoundError{"genre", id}
+	}
+	genre := e.Genre
 	album := Item{Name: genre}
 
 	// Get the first
@@ -392,122 +452,217 @@ func (r *Client) GetGenreTracks(id int) Item {
 
 	sort.Sort(ByArtistE(album.Tracks))
 
-	return album
+	return album, nil
 }
 
-func (r *Client) GetArtist(id int) Entry {
-	return r.Db.Entries[id]
+func (r *Client) GetArtist(id int) (Entry, error) {
+	e, err := r.GetTrack(id)
+	if err != nil || len(e.Artist) == 0 {
+		return Entry{}, NotFoundError{"artist", id}
+	}
+	return e, nil
 }
 
-func (r *Client) PlayAlbum(id int) {
+func (r *Client) PlayAlbum(id int) error {
+	a, err := r.GetAlbum(id)
+	if err != nil {
+		return err
+	}
 	r.ClearQueue()
-	r.EnqueueAlbum(id)
+	r.enqueueTracks(a.Tracks)
 	r.Play()
+	return nil
 }
 
-func (r *Client) PlayAlbumRandomly(id int) {
-	a := r.GetAlbum(id)
-
-	// Sort tracks randomly
-	sort.Sort(ByRandom(a.Tracks))
-
-	r.ClearQueue()
-	for _, e := range a.Tracks {
-		r.Enqueue(e.Location)
-		fmt.Println(e.Title)
+// Play the album in a random order, see playShuffled for the seed
+func (r *Client) PlayAlbumRandomly(id int, seed int64) (int64, error) {
+	a, err := r.GetAlbum(id)
+	if err != nil {
+		return 0, err
 	}
-	r.Play()
+	return r.playShuffled(a.Tracks, seed, ShuffleRandom), nil
 }
 
-func (r *Client) EnqueueAlbum(id int) {
-
-	a := r.GetAlbum(id)
+func (r *Client) EnqueueAlbum(id int) error {
+	a, err := r.GetAlbum(id)
+	if err != nil {
+		return err
+	}
 
 	// Sort tracks by tracknumber
 	sort.Sort(ByTrackNumber(a.Tracks))
 
-	for _, e := range a.Tracks {
-		r.Enqueue(e.Location)
-	}
+	r.enqueueTracks(a.Tracks)
+	return nil
 }
 
-func (r *Client) EnqueueArtist(id int) {
-
-	a := r.GetArtistsTracks(id)
-
-	for _, f := range a.Tracks {
-		r.Enqueue(f.Location)
+func (r *Client) EnqueueArtist(id int) error {
+	a, err := r.GetArtistsTracks(id)
+	if err != nil {
+		return err
 	}
-
+	r.enqueueTracks(a.Tracks)
+	return nil
 }
 
-func (r *Client) PlayArtist(id int) {
+func (r *Client) PlayArtist(id int) error {
+	a, err := r.GetArtistsTracks(id)
+	if err != nil {
+		return err
+	}
 	r.ClearQueue()
-	r.EnqueueArtist(id)
+	r.enqueueTracks(a.Tracks)
 	r.Play()
+	return nil
 }
 
-func (r *Client) PlayArtistRandomly(id int) {
-	a := r.GetArtistsTracks(id)
-
-	r.ClearQueue()
+// Play the artist in a random order, see playShuffled for the seed and mode
+func (r *Client) PlayArtistRandomly(id int, seed int64, mode string) (int64, error) {
+	a, err := r.GetArtistsTracks(id)
+	if err != nil {
+		return 0, err
+	}
+	return r.playShuffled(a.Tracks, seed, mode), nil
+}
 
-	// Sort tracks randomly
-	sort.Sort(ByRandom(a.Tracks))
-	for _, f := range a.Tracks {
-		r.Enqueue(f.Location)
+func (r *Client) EnqueueGenre(id int) error {
+	a, err := r.GetGenreTracks(id)
+	if err != nil {
+		return err
 	}
+	r.enqueueTracks(a.Tracks)
+	return nil
+}
 
+func (r *Client) PlayGenre(id int) error {
+	a, err := r.GetGenreTracks(id)
+	if err != nil {
+		return err
+	}
+	r.ClearQueue()
+	r.enqueueTracks(a.Tracks)
 	r.Play()
+	return nil
 }
 
-func (r *Client) EnqueueGenre(id int) {
-
-	a := r.GetGenreTracks(id)
-
-	for _, f := range a.Tracks {
-		r.Enqueue(f.Location)
+// Play the genre in a random order, see playShuffled for the seed and mode
+func (r *Client) PlayGenreRandomly(id int, seed int64, mode string) (int64, error) {
+	a, err := r.GetGenreTracks(id)
+	if err != nil {
+		return 0, err
 	}
-
+	return r.playShuffled(a.Tracks, seed, mode), nil
 }
 
-func (r *Client) PlayGenre(id int) {
+func (r *Client) PlayTrack(id int) error {
+	e, err := r.GetTrack(id)
+	if err != nil {
+		return err
+	}
 	r.ClearQueue()
-	r.EnqueueGenre(id)
+	r.Enqueue(e.Location)
 	r.Play()
+	return nil
 }
 
-func (r *Client) PlayGenreRandomly(id int) {
-	a := r.GetGenreTracks(id)
+func (r *Client) EnqueueTrack(id int) error {
+	e, err := r.GetTrack(id)
+	if err != nil {
+		return err
+	}
+	r.Enqueue(e.Location)
+	return nil
+}
 
-	r.ClearQueue()
+func (r *Client) enqueueTracks(tracks []Entry) {
+	for _, e := range tracks {
+		r.Enqueue(e.Location)
+	}
+}
 
-	// Sort tracks randomly
-	sort.Sort(ByRandom(a.Tracks))
-	for _, f := range a.Tracks {
-		r.Enqueue(f.Location)
+// Play a track and carry on with the rest of the album after it. With shuffle
+// on, the other tracks on the album follow in a random order instead.
+func (r *Client) PlayAlbumFrom(albumId, trackId int, shuffle bool) error {
+	a, err := r.GetAlbum(albumId)
+	if err != nil {
+		return err
 	}
+	return r.playFrom(a.Tracks, trackId, shuffle)
+}
 
-	r.Play()
+// Play a track and carry on with the rest of the genre after it
+func (r *Client) PlayGenreFrom(genreId, trackId int, shuffle bool) error {
+	g, err := r.GetGenreTracks(genreId)
+	if err != nil {
+		return err
+	}
+	return r.playFrom(g.Tracks, trackId, shuffle)
 }
 
-func (r *Client) PlayTrack(id int) {
+func (r *Client) playFrom(tracks []Entry, trackId int, shuffle bool) error {
+	var rest []Entry
+	found := false
+	for i, e := range tracks {
+		if e.Id != trackId {
+			continue
+		}
+		if shuffle {
+			rest = append(rest, tracks[:i]...)
+		}
+		rest = append(rest, tracks[i+1:]...)
+		found = true
+		break
+	}
+	if !found {
+		return NotFoundError{"track", trackId}
+	}
+
+	if shuffle {
+		ShuffleTracks(rest, NewSeed())
+	}
+
 	r.ClearQueue()
-	r.Enqueue(r.Db.Entries[id].Location)
+	r.Enqueue(r.Db.Entries[trackId].Location)
+	for _, e := range rest {
+		r.Enqueue(e.Location)
+	}
 	r.Play()
+	return nil
 }
 
 // Assume that we are running from the users account which has Rhythmbox
 // installed - therefore as long as the version of Rhythmbox is recentish, the
 // lib should be located in .local/share/....
 func (r *Client) GuessLibrary() {
+	r.Library = filepath.Join(DataHome(), RhythmboxXmlLibrary)
+	fmt.Println(r.Library)
+}
+
+// Keep our own data next to Rhythmbox's
+func (r *Client) GuessDataDir() {
+	r.DataDir = filepath.Join(DataHome(), GorhythmboxDataDir)
+}
+
+// $XDG_DATA_HOME, or .local/share if that isn't set
+func DataHome() string {
+	return xdgDir("XDG_DATA_HOME", ".local/share")
+}
+
+// $XDG_CACHE_HOME, or .cache if that isn't set
+func CacheHome() string {
+	return xdgDir("XDG_CACHE_HOME", ".cache")
+}
+
+func xdgDir(env, fallback string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+
 	usr, err := user.Current()
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	r.Library = strings.Replace(RhythmboxXmlLibrary, "$HOME", usr.HomeDir, 1)
-	fmt.Println(r.Library)
+	return filepath.Join(usr.HomeDir, fallback)
 }
 
 // Executes the options against the actual client
@@ -520,27 +675,47 @@ func (r *Client) Execute(s ...string) {
 
 // Executes the options against the actual client
 func (r *Client) ExecuteAndReturn(s ...string) string {
-
-	cmd := exec.Command(RhythmboxClient, s...) //s[0], s[1]) //"--enqueue", "file:///home/ae/Music/Doolittle%20%5BMFSL%5D/Pixies%20-%20Doolittle%20(MFSL)%20-%2002%20-%20Tame.flac")
-	out, err := cmd.Output()
-	// fmt.Println(s)
-	// fmt.Println(out)
+	out, err := r.output(s...)
 	if err != nil {
 		return string(err.Error())
 	}
 
-	return string(out)
+	return out
 }
 
-var randSeed int64 = 1
+// The same, but with the error kept apart, for when the output is a value
+// rather than something to show
+func (r *Client) output(s ...string) (string, error) {
+
+	bin := r.ClientBinary
+	if len(bin) == 0 {
+		bin = RhythmboxClient
+	}
 
-func random(min, max int) int {
-	randSeed++
-	rand.Seed(time.Now().Unix() + randSeed)
-	return rand.Intn(max-min) + min
+	cmd := exec.Command(bin, s...) //s[0], s[1]) //"--enqueue", "file:///home/ae/Music/Doolittle%20%5BMFSL%5D/Pixies%20-%20Doolittle%20(MFSL)%20-%2002%20-%20Tame.flac")
+	out, err := cmd.Output()
+	// fmt.Println(s)
+	// fmt.Println(out)
+	return string(out), err
 }
 
-func RandBool() bool {
-	a := random(1, 3)
-	return a == 1
+// Turn a duration printed by the client ("4:05" or "1:02:03") into seconds
+func ParseDuration(s string) int {
+	seconds := 0
+	for _, part := range strings.Split(strings.TrimSpace(s), ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds
+}
+
+// Turn seconds into "4:05", or "1:02:03" for an hour or more
+func FormatDuration(seconds int) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
 }
@@ -0,0 +1,141 @@
+package rhythmbox
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// A library of a few albums, with a cover for the first, that plays through a
+// client that does nothing
+func testClient(t *testing.T) *Client {
+	dir := t.TempDir()
+	albums := []struct{ name, artist, genre string }{
+		{"Zalbum", "Zed", "Rock"},
+		{"Aalbum", "Amy", "Jazz"},
+		{"Malbum", "Mo", "Ambient"},
+	}
+	xml := `<rhythmdb version="1.8">` + "\n"
+	for i, a := range albums {
+		albumDir := filepath.Join(dir, a.name)
+		os.MkdirAll(albumDir, 0755)
+		for n := 1; n <= 3; n++ {
+			xml += fmt.Sprintf(`<entry type="song"><title>%v %d</title><genre>%v</genre><artist>%v</artist>`+
+				`<album>%v</album><duration>200</duration><track-number>%d</track-number>`+
+				`<location>file://%v/%d.mp3</location></entry>`+"\n",
+				a.name, n, a.genre, a.artist, a.name, n, albumDir, n)
+		}
+		if i == 0 {
+			f, err := os.Create(filepath.Join(albumDir, "cover.png"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			png.Encode(f, image.NewGray(image.Rect(0, 0, 8, 8)))
+			f.Close()
+		}
+	}
+	xml += "</rhythmdb>\n"
+	library := filepath.Join(dir, "rhythmdb.xml")
+	if err := ioutil.WriteFile(library, []byte(xml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Client{
+		Library:      library,
+		DataDir:      filepath.Join(dir, "data"),
+		ArtDir:       filepath.Join(dir, "art"),
+		ClientBinary: "true",
+	}
+	r.Setup()
+	if len(r.Albums) != len(albums) {
+		t.Fatalf("Set up %v albums, want %v", len(r.Albums), len(albums))
+	}
+	return r
+}
+
+// Requests all share the one client, run with -race
+func TestConcurrentRequests(t *testing.T) {
+	r := testClient(t)
+
+	// Setup leaves the albums without their tracks, give them some so there
+	// is something shared under each item too
+	for i, a := range r.Albums {
+		album, err := r.GetAlbum(a.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Albums[i].Tracks = album.Tracks
+	}
+
+	// What is handed out can be changed without upsetting anyone
+	change := func(albums []Item) {
+		for k := range albums {
+			albums[k].Name = "changed"
+			for j := range albums[k].Tracks {
+				albums[k].Tracks[j].Title = "changed"
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				albums := r.GetAlbums()
+				change(albums)
+
+				id := albums[(i+n)%len(albums)].Id
+				byArtist, err := r.GetArtistsAlbums(id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(byArtist) == 0 || len(byArtist[0].Tracks) == 0 {
+					t.Errorf("No tracks for the albums by the artist of %v", id)
+				}
+				change(byArtist)
+
+				a, err := r.GetAlbum(id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				a.Tracks[0].Title = "changed"
+
+				if _, err := r.PlayAlbumRandomly(id, NewSeed()); err != nil {
+					t.Error(err)
+				}
+				if _, err := r.AlbumArt(id); err != nil && !IsNotFound(err) {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, a := range r.GetAlbums() {
+		if a.Name == "changed" {
+			t.Errorf("Album %v was changed", a.Id)
+		}
+		for _, e := range a.Tracks {
+			if e.Title == "changed" {
+				t.Errorf("Track %v was changed", e.Id)
+			}
+		}
+	}
+	for _, e := range r.Db.Entries {
+		if e.Title == "changed" {
+			t.Errorf("Track %v was changed", e.Id)
+		}
+	}
+	if !r.HasAlbumArt(r.Albums[len(r.Albums)-1].Id) {
+		t.Errorf("No art for %v", r.Albums[len(r.Albums)-1].Name)
+	}
+}
@@ -0,0 +1,403 @@
+package rhythmbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a schedule plays
+const (
+	ScheduleAlbum    = "album"
+	ScheduleGenre    = "genre"
+	SchedulePlaylist = "playlist"
+	ScheduleRadio    = "radio"
+)
+
+// Where schedules and their log are kept, in the data dir
+const SchedulesFile = "schedules.json"
+
+// How many runs the log keeps
+const scheduleLogSize = 100
+
+// Start playing something at a time of day, on some days of the week
+type Schedule struct {
+	Id        int
+	Name      string
+	Enabled   bool
+	Hour      int
+	Minute    int
+	Days      [7]bool // Indexed by time.Weekday, Sunday first
+	Kind      string
+	RadioSeed string  // For radio, whether it starts from an album or artist
+	Volume    float64 // Fade up to this, 0 - 1
+	FadeIn    int     // Seconds
+
+	// What to play, by name. Rhythmbox numbers everything again when it
+	// rewrites its files, so Ids can't be kept. Only what the kind needs is set.
+	Album    string `json:",omitempty"` // With Artist, for an album or radio from one
+	Artist   string `json:",omitempty"`
+	Genre    string `json:",omitempty"`
+	Playlist string `json:",omitempty"`
+
+	// The album, genre or artist entry, or the playlist Id, in the library as
+	// it is now, -1 if it has gone. Never saved, it is worked out from the
+	// names when schedules are handed out, and SaveSchedule goes the other way.
+	Target int `json:"-"`
+}
+
+// One go of a schedule, for the log
+type ScheduleRun struct {
+	Schedule int
+	Name     string
+	Time     time.Time
+	Error    string
+}
+
+type schedules struct {
+	mu        sync.Mutex
+	Schedules []Schedule
+	Log       []ScheduleRun
+	lastRun   map[int]time.Time
+}
+
+func (s Schedule) TimeString() string {
+	return fmt.Sprintf("%02d:%02d", s.Hour, s.Minute)
+}
+
+// The days it goes off, like "Weekdays" or "Mon Wed Fri"
+func (s Schedule) DaysString() string {
+	switch s.Days {
+	case [7]bool{true, true, true, true, true, true, true}:
+		return "Every day"
+	case [7]bool{false, true, true, true, true, true, false}:
+		return "Weekdays"
+	case [7]bool{true, false, false, false, false, false, true}:
+		return "Weekends"
+	case [7]bool{}:
+		return "Never"
+	}
+
+	days := ""
+	for d, on := range s.Days {
+		if on {
+			days += time.Weekday(d).String()[:3] + " "
+		}
+	}
+	return strings.TrimSpace(days)
+}
+
+// What it plays, like "Radio like Miles Davis"
+func (s Schedule) What() string {
+	switch {
+	case s.Kind == ScheduleAlbum:
+		return s.Artist + " - " + s.Album
+	case s.Kind == ScheduleGenre:
+		return s.Genre
+	case s.Kind == SchedulePlaylist:
+		return s.Playlist
+	case s.RadioSeed == RadioAlbum:
+		return "Radio like " + s.Artist + " - " + s.Album
+	}
+	return "Radio like " + s.Artist
+}
+
+func (s Schedule) VolumePercent() int {
+	return int(s.Volume*100 + 0.5)
+}
+
+// Whether the schedule should go off in the minute t is in
+func (s Schedule) Due(t time.Time) bool {
+	return s.Enabled && s.Days[t.Weekday()] && t.Hour() == s.Hour && t.Minute() == s.Minute
+}
+
+func (r *Client) schedulesPath() string {
+	return filepath.Join(r.DataDir, SchedulesFile)
+}
+
+// Read the schedules back in, it is fine if there are none yet
+func (r *Client) loadSchedules() {
+	r.schedules.mu.Lock()
+	defer r.schedules.mu.Unlock()
+
+	file, err := ioutil.ReadFile(r.schedulesPath())
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(file, &r.schedules)
+	if err != nil {
+		fmt.Printf("[ERRO] Could not load schedules: %v\n", err)
+	}
+}
+
+// Call with the lock held
+func (r *Client) saveSchedules() error {
+	data, err := json.MarshalIndent(&r.schedules, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(r.DataDir, 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.schedulesPath(), data, 0644)
+}
+
+func (r *Client) Schedules() []Schedule {
+	r.schedules.mu.Lock()
+	defer r.schedules.mu.Unlock()
+
+	schedules := make([]Schedule, len(r.schedules.Schedules))
+	for i, s := range r.schedules.Schedules {
+		s.Target = r.scheduleTarget(s)
+		schedules[i] = s
+	}
+	return schedules
+}
+
+// The log, newest first
+func (r *Client) ScheduleLog() []ScheduleRun {
+	r.schedules.mu.Lock()
+	defer r.schedules.mu.Unlock()
+
+	log := make([]ScheduleRun, len(r.schedules.Log))
+	for i, run := range r.schedules.Log {
+		log[len(log)-1-i] = run
+	}
+	return log
+}
+
+func (r *Client) GetSchedule(id int) (Schedule, bool) {
+	r.schedules.mu.Lock()
+	defer r.schedules.mu.Unlock()
+
+	for _, s := range r.schedules.Schedules {
+		if s.Id == id {
+			s.Target = r.scheduleTarget(s)
+			return s, true
+		}
+	}
+	return Schedule{}, false
+}
+
+// Add a schedule, or replace the one with the same Id. An Id of 0 is a new one.
+// What it plays is given by Target, and kept by name.
+func (r *Client) SaveSchedule(s Schedule) error {
+	if s.Hour < 0 || s.Hour > 23 || s.Minute < 0 || s.Minute > 59 {
+		return errors.New("That is not a time of day")
+	}
+	if s.Volume <= 0 || s.Volume > 1 {
+		s.Volume = 1
+	}
+	if s.FadeIn < 0 {
+		s.FadeIn = 0
+	}
+	s, err := r.scheduleNames(s)
+	if err != nil {
+		return err
+	}
+
+	r.schedules.mu.Lock()
+	defer r.schedules.mu.Unlock()
+
+	if s.Id == 0 {
+		for _, o := range r.schedules.Schedules {
+			if o.Id > s.Id {
+				s.Id = o.Id
+			}
+		}
+		s.Id++
+		r.schedules.Schedules = append(r.schedules.Schedules, s)
+	} else {
+		found := false
+		for i, o := range r.schedules.Schedules {
+			if o.Id == s.Id {
+				r.schedules.Schedules[i] = s
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("No such schedule")
+		}
+	}
+
+	return r.saveSchedules()
+}
+
+func (r *Client) DeleteSchedule(id int) error {
+	r.schedules.mu.Lock()
+	defer r.schedules.mu.Unlock()
+
+	for i, s := range r.schedules.Schedules {
+		if s.Id == id {
+			r.schedules.Schedules = append(r.schedules.Schedules[:i], r.schedules.Schedules[i+1:]...)
+			return r.saveSchedules()
+		}
+	}
+	return errors.New("No such schedule")
+}
+
+// Fill in the names of what the schedule plays from its Target
+func (r *Client) scheduleNames(s Schedule) (Schedule, error) {
+	s.Album, s.Artist, s.Genre, s.Playlist = "", "", "", ""
+
+	switch s.Kind {
+	case SchedulePlaylist:
+		if s.Target < 0 || s.Target >= len(r.Playlists) {
+			return s, errors.New("Pick a playlist")
+		}
+		s.Playlist = r.Playlists[s.Target].Name
+		return s, nil
+	case ScheduleAlbum, ScheduleGenre:
+		s.RadioSeed = ""
+	case ScheduleRadio:
+		if len(s.RadioSeed) == 0 {
+			s.RadioSeed = RadioArtist
+		}
+		if s.RadioSeed != RadioAlbum && s.RadioSeed != RadioArtist {
+			return s, errors.New("Radio alarms start from an album or an artist")
+		}
+	default:
+		return s, errors.New("Unknown schedule: " + s.Kind)
+	}
+
+	e, err := r.GetTrack(s.Target)
+	if err != nil {
+		return s, errors.New("Pick something to play")
+	}
+	switch {
+	case s.Kind == ScheduleGenre:
+		s.Genre = e.Genre
+	case s.Kind == ScheduleAlbum, s.RadioSeed == RadioAlbum:
+		s.Album, s.Artist = e.Album, e.Artist
+	default:
+		s.Artist = e.Artist
+	}
+	if r.scheduleTarget(s) < 0 {
+		return s, errors.New("Pick something to play")
+	}
+	return s, nil
+}
+
+// Find what the schedule plays in the library as it is now, -1 if it is gone
+func (r *Client) scheduleTarget(s Schedule) int {
+	switch {
+	case s.Kind == SchedulePlaylist:
+		for _, p := range r.Playlists {
+			if p.Name == s.Playlist {
+				return p.Id
+			}
+		}
+	case s.Kind == ScheduleGenre:
+		for _, g := range r.Genres {
+			if g.Name == s.Genre {
+				return g.Id
+			}
+		}
+	case s.Kind == ScheduleAlbum, s.Kind == ScheduleRadio && s.RadioSeed == RadioAlbum:
+		if len(s.Album) == 0 {
+			break
+		}
+		if id, ok := r.albumIds[[2]string{s.Album, s.Artist}]; ok {
+			return id
+		}
+		// Listed under another artist, any of the artist's tracks on it will do
+		for _, e := range r.Db.Entries {
+			if e.Album == s.Album && e.Artist == s.Artist {
+				return e.Id
+			}
+		}
+	case s.Kind == ScheduleRadio:
+		for _, a := range r.Artists {
+			if a.Name == s.Artist {
+				return a.Id
+			}
+		}
+	}
+	return -1
+}
+
+// Check the schedules forever, starting any that are due. They are read in
+// by Setup, so nothing saved in the meantime gets lost.
+func (r *Client) RunSchedules() {
+	for {
+		now := time.Now()
+		for _, s := range r.Schedules() {
+			if !s.Due(now) {
+				continue
+			}
+
+			// Only once a minute
+			r.schedules.mu.Lock()
+			if r.schedules.lastRun == nil {
+				r.schedules.lastRun = make(map[int]time.Time)
+			}
+			last := r.schedules.lastRun[s.Id]
+			due := now.Sub(last) > time.Minute
+			if due {
+				r.schedules.lastRun[s.Id] = now
+			}
+			r.schedules.mu.Unlock()
+
+			if due {
+				go r.RunSchedule(s)
+			}
+		}
+
+		time.Sleep(20 * time.Second)
+	}
+}
+
+// Start playing what the schedule says, fading the volume in, and log it
+func (r *Client) RunSchedule(s Schedule) {
+	run := ScheduleRun{Schedule: s.Id, Name: s.Name, Time: time.Now()}
+
+	if s.FadeIn > 0 {
+		r.SetVolume(0)
+	} else {
+		r.SetVolume(s.Volume)
+	}
+
+	// Whatever it is may have moved since the schedule was saved
+	target := r.scheduleTarget(s)
+	var err error
+	switch {
+	case target < 0:
+		err = errors.New(s.What() + " is no longer in the library")
+	case s.Kind == ScheduleAlbum:
+		err = r.PlayAlbum(target)
+	case s.Kind == ScheduleGenre:
+		err = r.PlayGenre(target)
+	case s.Kind == SchedulePlaylist:
+		r.PlayPlaylist(target)
+	case s.Kind == ScheduleRadio:
+		err = r.StartRadio(s.RadioSeed, target)
+	default:
+		err = errors.New("Unknown schedule: " + s.Kind)
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	r.schedules.mu.Lock()
+	r.schedules.Log = append(r.schedules.Log, run)
+	if len(r.schedules.Log) > scheduleLogSize {
+		r.schedules.Log = r.schedules.Log[len(r.schedules.Log)-scheduleLogSize:]
+	}
+	if err := r.saveSchedules(); err != nil {
+		fmt.Printf("[ERRO] Could not save schedules: %v\n", err)
+	}
+	r.schedules.mu.Unlock()
+
+	// A step a second up to the volume wanted
+	for i := 1; i <= s.FadeIn; i++ {
+		time.Sleep(time.Second)
+		r.SetVolume(s.Volume * float64(i) / float64(s.FadeIn))
+	}
+}
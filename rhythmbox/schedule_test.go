@@ -0,0 +1,96 @@
+package rhythmbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Rhythmbox rewrites its library in another order, alarms should still play
+// what they did
+func TestScheduleKeepsTarget(t *testing.T) {
+	r := testClient(t)
+	find := func(items []Item, name string) int {
+		for _, i := range items {
+			if i.Name == name {
+				return i.Id
+			}
+		}
+		t.Fatalf("No %v", name)
+		return -1
+	}
+
+	saved := []Schedule{
+		{Kind: ScheduleAlbum, Target: find(r.Albums, "Malbum")},
+		{Kind: ScheduleGenre, Target: find(r.Genres, "Jazz")},
+		{Kind: ScheduleRadio, RadioSeed: RadioArtist, Target: find(r.Artists, "Zed")},
+		{Kind: ScheduleRadio, RadioSeed: RadioAlbum, Target: find(r.Albums, "Aalbum")},
+	}
+	for _, s := range saved {
+		if err := r.SaveSchedule(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Same entries, the first few moved to the end
+	data, err := ioutil.ReadFile(r.Library)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	entries := lines[1 : len(lines)-1]
+	entries = append(entries[4:], entries[:4]...)
+	lines = append(append(lines[:1:1], entries...), lines[len(lines)-1])
+	library := filepath.Join(t.TempDir(), "rhythmdb.xml")
+	if err := ioutil.WriteFile(library, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	moved := &Client{Library: library, DataDir: r.DataDir, ArtDir: r.ArtDir, ClientBinary: "true"}
+	moved.Setup()
+
+	got := moved.Schedules()
+	if len(got) != len(saved) {
+		t.Fatalf("Read back %v schedules, want %v", len(got), len(saved))
+	}
+	for i, s := range got {
+		before, _ := r.GetTrack(saved[i].Target)
+		after, err := moved.GetTrack(s.Target)
+		if err != nil {
+			t.Errorf("%v: %v", s.What(), err)
+			continue
+		}
+		if s.Target == saved[i].Target {
+			t.Errorf("%v: still %v, the library wasn't moved", s.What(), s.Target)
+		}
+		if after.Album != before.Album || after.Genre != before.Genre || after.Artist != before.Artist {
+			t.Errorf("%v: was %+v, now %+v", s.What(), before, after)
+		}
+	}
+
+	// And when it has gone altogether
+	empty := filepath.Join(t.TempDir(), "rhythmdb.xml")
+	ioutil.WriteFile(empty, []byte(`<rhythmdb version="1.8"></rhythmdb>`), 0644)
+	gone := &Client{Library: empty, DataDir: r.DataDir, ArtDir: r.ArtDir, ClientBinary: "true"}
+	gone.Setup()
+	for _, s := range gone.Schedules() {
+		if s.Target != -1 {
+			t.Errorf("%v is %v in an empty library", s.What(), s.Target)
+		}
+	}
+}
+
+func TestScheduleNeedsTarget(t *testing.T) {
+	r := testClient(t)
+	for _, s := range []Schedule{
+		{Kind: ScheduleAlbum, Target: -1},
+		{Kind: ScheduleAlbum, Target: len(r.Db.Entries)},
+		{Kind: SchedulePlaylist, Target: 0},
+		{Kind: ScheduleRadio, RadioSeed: RadioTrack, Target: 0},
+		{Kind: "nap", Target: 0},
+	} {
+		if err := r.SaveSchedule(s); err == nil {
+			t.Errorf("Saved %+v", s)
+		}
+	}
+}
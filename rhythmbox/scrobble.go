@@ -0,0 +1,506 @@
+package rhythmbox
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Services we can scrobble to
+const (
+	ScrobbleListenBrainz = "listenbrainz"
+	ScrobbleLastFm       = "lastfm" // Or anything with the same API, like Libre.fm
+)
+
+// Where the services are set up, and where scrobbles wait to be sent, in the
+// data dir
+const (
+	ScrobblersFile    = "scrobblers.json"
+	ScrobbleQueueFile = "scrobble-queue.json"
+)
+
+// A play is scrobbled once half of it, or this long, has been listened to
+const ScrobbleAfter = 4 * time.Minute
+
+// Tracks shorter than this are never scrobbled
+const ScrobbleMinDuration = 30
+
+// How long to wait between goes at the queue, and the longest we back off to
+const (
+	scrobbleInterval   = 30 * time.Second
+	scrobbleMaxBackoff = time.Hour
+)
+
+// Last.fm errors that won't go away by trying again
+const (
+	lastFmInvalidSession  = 9
+	lastFmInvalidAPIKey   = 10
+	lastFmSuspendedAPIKey = 26
+)
+
+var scrobbleBaseURLs = map[string]string{
+	ScrobbleListenBrainz: "https://api.listenbrainz.org",
+	ScrobbleLastFm:       "https://ws.audioscrobbler.com",
+}
+
+/*
+[
+  {"Service": "listenbrainz", "Token": "..."},
+  {"Name": "librefm", "Service": "lastfm", "BaseURL": "https://libre.fm", "APIKey": "...", "Secret": "...", "SessionKey": "..."}
+]
+*/
+
+// One service to scrobble to. BaseURL can point anywhere with the same API,
+// like a local server for trying things out.
+type Scrobbler struct {
+	Name    string // Defaults to the service
+	Service string
+	BaseURL string // Defaults to the service's own
+
+	Token string // ListenBrainz user token
+
+	APIKey     string // Last.fm
+	Secret     string
+	SessionKey string
+}
+
+// A finished play waiting to be sent to one scrobbler
+type Scrobble struct {
+	Scrobbler string
+	Play      Play
+	Tries     int
+	NextTry   time.Time
+	LastError string
+}
+
+type scrobbles struct {
+	mu         sync.Mutex
+	scrobblers []Scrobbler
+	queue      []Scrobble
+	wake       chan bool
+	http       *http.Client
+	off        map[string]bool // Scrobblers turned off until restart
+}
+
+// An error that trying again won't fix, like a bad session key
+type permanentError struct {
+	error
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// The service won't take this one play, like one with no artist. Trying it
+// again won't help, but the plays after it can still go.
+type rejectedError struct {
+	error
+}
+
+func isRejected(err error) bool {
+	_, ok := err.(rejectedError)
+	return ok
+}
+
+// A 4xx that isn't asking us to slow down is about what we sent
+func rejectedStatus(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
+
+// Whether enough of the play was listened to for it to be scrobbled
+func (p Play) Scrobblable() bool {
+	if p.Duration < ScrobbleMinDuration {
+		return false
+	}
+	return p.Listened*2 >= p.Duration || p.Listened >= int(ScrobbleAfter/time.Second)
+}
+
+func (s Scrobbler) baseURL() string {
+	if len(s.BaseURL) > 0 {
+		return strings.TrimRight(s.BaseURL, "/")
+	}
+	return scrobbleBaseURLs[s.Service]
+}
+
+func (r *Client) scrobblersPath() string {
+	return filepath.Join(r.DataDir, ScrobblersFile)
+}
+
+func (r *Client) scrobbleQueuePath() string {
+	return filepath.Join(r.DataDir, ScrobbleQueueFile)
+}
+
+// Read in the scrobblers and anything left in the queue, it is fine if there
+// is neither
+func (r *Client) loadScrobbles() {
+	if r.DisableScrobbling {
+		return
+	}
+
+	r.scrobbles.mu.Lock()
+	defer r.scrobbles.mu.Unlock()
+
+	file, err := ioutil.ReadFile(r.scrobblersPath())
+	if err == nil {
+		err = json.Unmarshal(file, &r.scrobbles.scrobblers)
+		if err != nil {
+			fmt.Printf("[ERRO] Could not load scrobblers: %v\n", err)
+		}
+	}
+	for i, s := range r.scrobbles.scrobblers {
+		if len(s.Name) == 0 {
+			r.scrobbles.scrobblers[i].Name = s.Service
+		}
+		if len(s.baseURL()) == 0 {
+			fmt.Printf("[ERRO] Unknown scrobbler: %v\n", s.Service)
+		}
+	}
+
+	file, err = ioutil.ReadFile(r.scrobbleQueuePath())
+	if err == nil {
+		err = json.Unmarshal(file, &r.scrobbles.queue)
+		if err != nil {
+			fmt.Printf("[ERRO] Could not load scrobble queue: %v\n", err)
+		}
+	}
+}
+
+// Call with the lock held. Written to a new file and moved over the old one so
+// a crash can't lose the queue.
+func (r *Client) saveScrobbleQueue() {
+	data, err := json.MarshalIndent(r.scrobbles.queue, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(r.DataDir, 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(r.scrobbleQueuePath()+".new", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(r.scrobbleQueuePath()+".new", r.scrobbleQueuePath())
+	}
+	if err != nil {
+		fmt.Printf("[ERRO] Could not save scrobble queue: %v\n", err)
+	}
+}
+
+// The scrobbles still waiting to be sent, oldest first
+func (r *Client) ScrobbleQueue() []Scrobble {
+	r.scrobbles.mu.Lock()
+	defer r.scrobbles.mu.Unlock()
+
+	queue := make([]Scrobble, len(r.scrobbles.queue))
+	copy(queue, r.scrobbles.queue)
+	return queue
+}
+
+// Queue a finished play for every scrobbler, called when the history saves it
+func (r *Client) scrobble(p Play) {
+	if !p.Scrobblable() {
+		return
+	}
+
+	r.scrobbles.mu.Lock()
+	defer r.scrobbles.mu.Unlock()
+
+	if len(r.scrobbles.scrobblers) == 0 {
+		return
+	}
+	for _, s := range r.scrobbles.scrobblers {
+		r.scrobbles.queue = append(r.scrobbles.queue, Scrobble{Scrobbler: s.Name, Play: p})
+	}
+	r.saveScrobbleQueue()
+
+	// Let the sender know without waiting on it
+	select {
+	case r.scrobbles.wake <- true:
+	default:
+	}
+}
+
+// Tell every scrobbler what has just started. These are not queued, they are
+// no use late.
+func (r *Client) scrobbleNowPlaying(p Play) {
+	r.scrobbles.mu.Lock()
+	scrobblers := make([]Scrobbler, len(r.scrobbles.scrobblers))
+	copy(scrobblers, r.scrobbles.scrobblers)
+	r.scrobbles.mu.Unlock()
+
+	for _, s := range scrobblers {
+		if r.scrobblerOff(s.Name) {
+			continue
+		}
+		go func(s Scrobbler) {
+			err := r.submit(s, p, true)
+			if err != nil {
+				fmt.Printf("[ERRO] Could not send now playing to %v: %v\n", s.Name, err)
+			}
+		}(s)
+	}
+}
+
+// Send the queue forever, backing off from scrobblers that aren't answering
+func (r *Client) RunScrobbler() {
+	r.scrobbles.mu.Lock()
+	r.scrobbles.wake = make(chan bool, 1)
+	wake := r.scrobbles.wake
+	r.scrobbles.mu.Unlock()
+
+	for {
+		r.sendScrobbles()
+
+		select {
+		case <-wake:
+		case <-time.After(scrobbleInterval):
+		}
+	}
+}
+
+// Have a go at everything in the queue that is due
+func (r *Client) sendScrobbles() {
+	now := time.Now()
+	failed := make(map[string]bool)
+
+	for _, q := range r.ScrobbleQueue() {
+		if failed[q.Scrobbler] || r.scrobblerOff(q.Scrobbler) {
+			continue
+		}
+		if q.NextTry.After(now) {
+			// Backing off, and the rest wait behind it
+			failed[q.Scrobbler] = true
+			continue
+		}
+		s, ok := r.getScrobbler(q.Scrobbler)
+		if !ok {
+			// Taken out of the config, nowhere to send it
+			r.finishScrobble(q, nil)
+			continue
+		}
+
+		err := r.submit(s, q.Play, false)
+		if isRejected(err) {
+			fmt.Printf("[ERRO] %v won't take %v, dropping it: %v\n", s.Name, TrackKey(q.Play.Artist, q.Play.Title), err)
+			r.finishScrobble(q, nil)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("[ERRO] Could not scrobble to %v: %v\n", s.Name, err)
+
+			// Keep the rest in order behind this one
+			failed[q.Scrobbler] = true
+		}
+		r.finishScrobble(q, err)
+
+		// The queue is kept, so it can go once the config is fixed
+		if isPermanent(err) {
+			fmt.Printf("[ERRO] Not scrobbling to %v until restarted\n", s.Name)
+			r.scrobbles.mu.Lock()
+			if r.scrobbles.off == nil {
+				r.scrobbles.off = make(map[string]bool)
+			}
+			r.scrobbles.off[s.Name] = true
+			r.scrobbles.mu.Unlock()
+		}
+	}
+}
+
+func (r *Client) scrobblerOff(name string) bool {
+	r.scrobbles.mu.Lock()
+	defer r.scrobbles.mu.Unlock()
+	return r.scrobbles.off[name]
+}
+
+func (r *Client) getScrobbler(name string) (Scrobbler, bool) {
+	r.scrobbles.mu.Lock()
+	defer r.scrobbles.mu.Unlock()
+
+	for _, s := range r.scrobbles.scrobblers {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Scrobbler{}, false
+}
+
+// Take a sent scrobble out of the queue, or put off trying a failed one again
+func (r *Client) finishScrobble(q Scrobble, err error) {
+	r.scrobbles.mu.Lock()
+	defer r.scrobbles.mu.Unlock()
+
+	for i, o := range r.scrobbles.queue {
+		if o.Scrobbler != q.Scrobbler || !o.Play.Started.Equal(q.Play.Started) || o.Play.Title != q.Play.Title {
+			continue
+		}
+		if err == nil {
+			r.scrobbles.queue = append(r.scrobbles.queue[:i], r.scrobbles.queue[i+1:]...)
+		} else {
+			// A minute, doubling each time, up to an hour
+			backoff := scrobbleMaxBackoff
+			if o.Tries < 6 {
+				backoff = time.Minute << uint(o.Tries)
+			}
+			r.scrobbles.queue[i].Tries++
+			r.scrobbles.queue[i].NextTry = time.Now().Add(backoff)
+			r.scrobbles.queue[i].LastError = err.Error()
+		}
+		r.saveScrobbleQueue()
+		return
+	}
+}
+
+// Send one play, as now playing or as a finished listen
+func (r *Client) submit(s Scrobbler, p Play, nowPlaying bool) error {
+	switch s.Service {
+	case ScrobbleListenBrainz:
+		return r.submitListenBrainz(s, p, nowPlaying)
+	case ScrobbleLastFm:
+		return r.submitLastFm(s, p, nowPlaying)
+	}
+	return errors.New("Unknown scrobbler: " + s.Service)
+}
+
+func (r *Client) httpClient() *http.Client {
+	r.scrobbles.mu.Lock()
+	defer r.scrobbles.mu.Unlock()
+
+	if r.scrobbles.http == nil {
+		r.scrobbles.http = &http.Client{Timeout: 30 * time.Second}
+	}
+	return r.scrobbles.http
+}
+
+// https://listenbrainz.readthedocs.io/en/latest/users/api/core.html
+func (r *Client) submitListenBrainz(s Scrobbler, p Play, nowPlaying bool) error {
+	listen := map[string]interface{}{
+		"track_metadata": map[string]interface{}{
+			"artist_name":  p.Artist,
+			"track_name":   p.Title,
+			"release_name": p.Album,
+			"additional_info": map[string]interface{}{
+				"duration_ms":       p.Duration * 1000,
+				"media_player":      "Rhythmbox",
+				"submission_client": "gorhythmbox",
+			},
+		},
+	}
+	listenType := "playing_now"
+	if !nowPlaying {
+		listenType = "single"
+		listen["listened_at"] = p.Started.Unix()
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"listen_type": listenType,
+		"payload":     []interface{}{listen},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.baseURL()+"/1/submit-listens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+s.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		err := errors.New(strings.TrimSpace(resp.Status + " " + result.Error))
+		if resp.StatusCode == http.StatusUnauthorized {
+			return permanentError{err}
+		}
+		if rejectedStatus(resp.StatusCode) {
+			return rejectedError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// https://www.last.fm/api/show/track.scrobble
+func (r *Client) submitLastFm(s Scrobbler, p Play, nowPlaying bool) error {
+	form := url.Values{
+		"artist":   {p.Artist},
+		"track":    {p.Title},
+		"album":    {p.Album},
+		"duration": {strconv.Itoa(p.Duration)},
+		"api_key":  {s.APIKey},
+		"sk":       {s.SessionKey},
+	}
+	if nowPlaying {
+		form.Set("method", "track.updateNowPlaying")
+	} else {
+		form.Set("method", "track.scrobble")
+		form.Set("timestamp", strconv.FormatInt(p.Started.Unix(), 10))
+	}
+	form.Set("api_sig", lastFmSignature(form, s.Secret))
+	form.Set("format", "json")
+
+	resp, err := r.httpClient().PostForm(s.baseURL()+"/2.0/", form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	switch result.Error {
+	case 0:
+	case lastFmInvalidSession, lastFmInvalidAPIKey, lastFmSuspendedAPIKey:
+		return permanentError{fmt.Errorf("%v %v", result.Error, result.Message)}
+	default:
+		err := fmt.Errorf("%v %v", result.Error, result.Message)
+		if rejectedStatus(resp.StatusCode) {
+			return rejectedError{err}
+		}
+		return err
+	}
+	if rejectedStatus(resp.StatusCode) {
+		return rejectedError{errors.New(resp.Status)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// The md5 of every parameter name and value, sorted by name, then the secret
+func lastFmSignature(form url.Values, secret string) string {
+	var keys []string
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sig := ""
+	for _, k := range keys {
+		sig += k + form.Get(k)
+	}
+	sum := md5.Sum([]byte(sig + secret))
+	return hex.EncodeToString(sum[:])
+}
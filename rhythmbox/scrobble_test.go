@@ -0,0 +1,304 @@
+package rhythmbox
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPlay = Play{
+	Title:    "Song",
+	Artist:   "Band",
+	Album:    "Record",
+	Started:  time.Unix(1500000000, 0),
+	Duration: 200,
+	Listened: 200,
+}
+
+// A client scrobbling to just the one scrobbler
+func scrobbleClient(t *testing.T, s Scrobbler) *Client {
+	r := &Client{DataDir: t.TempDir()}
+	r.scrobbles.scrobblers = []Scrobbler{s}
+	return r
+}
+
+// A server that answers with status and body, counting the requests
+type scrobbleServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+	status   int
+	body     string
+}
+
+func newScrobbleServer(t *testing.T) *scrobbleServer {
+	s := &scrobbleServer{status: http.StatusOK, body: "{}"}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		w.WriteHeader(s.status)
+		w.Write([]byte(s.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *scrobbleServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *scrobbleServer) answer(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.body = status, body
+}
+
+func TestListenBrainzPayload(t *testing.T) {
+	var got struct {
+		ListenType string `json:"listen_type"`
+		Payload    []struct {
+			ListenedAt    int64 `json:"listened_at"`
+			TrackMetadata struct {
+				ArtistName     string `json:"artist_name"`
+				TrackName      string `json:"track_name"`
+				ReleaseName    string `json:"release_name"`
+				AdditionalInfo struct {
+					DurationMs int `json:"duration_ms"`
+				} `json:"additional_info"`
+			} `json:"track_metadata"`
+		} `json:"payload"`
+	}
+	var auth, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth, path = req.Header.Get("Authorization"), req.URL.Path
+		json.NewDecoder(req.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	s := Scrobbler{Name: "lb", Service: ScrobbleListenBrainz, BaseURL: server.URL, Token: "tok"}
+	r := scrobbleClient(t, s)
+	if err := r.submit(s, testPlay, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/1/submit-listens" || auth != "Token tok" {
+		t.Errorf("Sent to %v with %q", path, auth)
+	}
+	if got.ListenType != "single" || len(got.Payload) != 1 {
+		t.Fatalf("Got %+v", got)
+	}
+	listen := got.Payload[0]
+	if listen.ListenedAt != testPlay.Started.Unix() {
+		t.Errorf("listened_at %v, want %v", listen.ListenedAt, testPlay.Started.Unix())
+	}
+	m := listen.TrackMetadata
+	if m.ArtistName != "Band" || m.TrackName != "Song" || m.ReleaseName != "Record" || m.AdditionalInfo.DurationMs != 200000 {
+		t.Errorf("Got %+v", m)
+	}
+
+	// Now playing has no time
+	got.Payload = nil
+	if err := r.submit(s, testPlay, true); err != nil {
+		t.Fatal(err)
+	}
+	if got.ListenType != "playing_now" || got.Payload[0].ListenedAt != 0 {
+		t.Errorf("Now playing got %+v", got)
+	}
+}
+
+func TestLastFmSignature(t *testing.T) {
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		form = req.PostForm
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	s := Scrobbler{Name: "lastfm", Service: ScrobbleLastFm, BaseURL: server.URL, APIKey: "key", Secret: "secret", SessionKey: "session"}
+	r := scrobbleClient(t, s)
+	if err := r.submit(s, testPlay, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sorted by name, format left out, secret on the end
+	sig := "albumRecord" + "api_keykey" + "artistBand" + "duration200" + "methodtrack.scrobble" +
+		"sksession" + "timestamp1500000000" + "trackSong" + "secret"
+	sum := md5.Sum([]byte(sig))
+	want := hex.EncodeToString(sum[:])
+	if got := form["api_sig"]; len(got) != 1 || got[0] != want {
+		t.Errorf("api_sig %v, want %v", got, want)
+	}
+	if got := form["format"]; len(got) != 1 || got[0] != "json" {
+		t.Errorf("format %v", got)
+	}
+}
+
+func TestScrobbleQueue(t *testing.T) {
+	server := newScrobbleServer(t)
+	server.answer(http.StatusServiceUnavailable, "{}")
+	s := Scrobbler{Name: "lb", Service: ScrobbleListenBrainz, BaseURL: server.URL, Token: "tok"}
+	r := scrobbleClient(t, s)
+
+	r.scrobble(testPlay)
+	second := testPlay
+	second.Title = "Other song"
+	second.Started = second.Started.Add(time.Hour)
+	r.scrobble(second)
+
+	// Only the first goes, the second waits behind it
+	r.sendScrobbles()
+	if server.count() != 1 {
+		t.Fatalf("%v requests, want 1", server.count())
+	}
+	queue := r.ScrobbleQueue()
+	if len(queue) != 2 || queue[0].Tries != 1 || queue[1].Tries != 0 || len(queue[0].LastError) == 0 {
+		t.Fatalf("Queue %+v", queue)
+	}
+	if wait := time.Until(queue[0].NextTry); wait < 50*time.Second || wait > time.Minute {
+		t.Errorf("Backed off %v, want a minute", wait)
+	}
+
+	// Not tried again until the backoff is up
+	r.sendScrobbles()
+	if server.count() != 1 {
+		t.Fatalf("%v requests, want 1", server.count())
+	}
+
+	// Backs off longer each time
+	r.scrobbles.mu.Lock()
+	r.scrobbles.queue[0].NextTry = time.Time{}
+	r.scrobbles.mu.Unlock()
+	r.sendScrobbles()
+	if wait := time.Until(r.ScrobbleQueue()[0].NextTry); wait < 110*time.Second || wait > 2*time.Minute {
+		t.Errorf("Backed off %v, want two minutes", wait)
+	}
+
+	// Still there after a restart
+	restarted := &Client{DataDir: r.DataDir}
+	restarted.loadScrobbles()
+	restarted.scrobbles.scrobblers = []Scrobbler{s}
+	queue = restarted.ScrobbleQueue()
+	if len(queue) != 2 || queue[0].Play.Title != "Song" || queue[0].Tries != 2 {
+		t.Fatalf("Loaded %+v", queue)
+	}
+
+	// Both go once it is answering, in order
+	server.answer(http.StatusOK, "{}")
+	restarted.scrobbles.queue[0].NextTry = time.Time{}
+	restarted.sendScrobbles()
+	if server.count() != 4 || len(restarted.ScrobbleQueue()) != 0 {
+		t.Errorf("%v requests, %v left", server.count(), len(restarted.ScrobbleQueue()))
+	}
+	again := &Client{DataDir: r.DataDir}
+	again.loadScrobbles()
+	if len(again.ScrobbleQueue()) != 0 {
+		t.Errorf("Saved %+v", again.ScrobbleQueue())
+	}
+}
+
+func TestLastFmInvalidSession(t *testing.T) {
+	server := newScrobbleServer(t)
+	server.answer(http.StatusForbidden, `{"error": 9, "message": "Invalid session key"}`)
+	s := Scrobbler{Name: "lastfm", Service: ScrobbleLastFm, BaseURL: server.URL, APIKey: "key", Secret: "secret", SessionKey: "old"}
+	r := scrobbleClient(t, s)
+
+	r.scrobble(testPlay)
+	r.sendScrobbles()
+
+	// Turned off rather than tried forever, but the play is kept
+	r.scrobbles.mu.Lock()
+	r.scrobbles.queue[0].NextTry = time.Time{}
+	r.scrobbles.mu.Unlock()
+	r.sendScrobbles()
+	r.scrobble(testPlay)
+	r.sendScrobbles()
+	if server.count() != 1 {
+		t.Errorf("%v requests, want 1", server.count())
+	}
+	if len(r.ScrobbleQueue()) != 2 {
+		t.Errorf("Queue %+v", r.ScrobbleQueue())
+	}
+}
+
+// One play the service won't take is dropped, the rest still go. Being told
+// to slow down is still backed off from.
+func TestScrobbleRejected(t *testing.T) {
+	tests := []struct {
+		service string
+		status  int
+		body    string
+		sent    int // Requests by the end
+		left    int // Still queued
+	}{
+		{ScrobbleListenBrainz, http.StatusBadRequest, `{"error": "No artist"}`, 3, 0},
+		{ScrobbleListenBrainz, http.StatusRequestEntityTooLarge, `{}`, 3, 0},
+		{ScrobbleListenBrainz, http.StatusTooManyRequests, `{}`, 2, 2},
+		{ScrobbleListenBrainz, http.StatusBadGateway, `{}`, 2, 2},
+		{ScrobbleLastFm, http.StatusBadRequest, `{"error": 6, "message": "Invalid parameters"}`, 3, 0},
+		{ScrobbleLastFm, http.StatusServiceUnavailable, `{"error": 16, "message": "Try again"}`, 2, 2},
+	}
+
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var tracks []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			track := req.PostFormValue("track")
+			if tt.service == ScrobbleListenBrainz {
+				var got struct {
+					Payload []struct {
+						TrackMetadata struct {
+							TrackName string `json:"track_name"`
+						} `json:"track_metadata"`
+					} `json:"payload"`
+				}
+				json.NewDecoder(req.Body).Decode(&got)
+				track = got.Payload[0].TrackMetadata.TrackName
+			}
+			mu.Lock()
+			tracks = append(tracks, track)
+			mu.Unlock()
+			if track == "Bad" {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+				return
+			}
+			w.Write([]byte("{}"))
+		}))
+		defer server.Close()
+
+		s := Scrobbler{Name: tt.service, Service: tt.service, BaseURL: server.URL, Token: "tok", APIKey: "key", Secret: "secret", SessionKey: "sk"}
+		r := scrobbleClient(t, s)
+		for i, title := range []string{"First", "Bad", "Last"} {
+			p := testPlay
+			p.Title = title
+			p.Started = p.Started.Add(time.Duration(i) * time.Hour)
+			r.scrobble(p)
+		}
+
+		r.sendScrobbles()
+		name := fmt.Sprintf("%v %v", tt.service, tt.status)
+		if len(tracks) != tt.sent {
+			t.Errorf("%v: sent %v, want %v requests", name, tracks, tt.sent)
+		}
+		queue := r.ScrobbleQueue()
+		if len(queue) != tt.left {
+			t.Errorf("%v: %v left, want %v", name, len(queue), tt.left)
+		}
+		if len(queue) > 0 && queue[0].Play.Title != "Bad" {
+			t.Errorf("%v: %v is first in the queue, want Bad", name, queue[0].Play.Title)
+		}
+		if r.scrobblerOff(s.Name) {
+			t.Errorf("%v: turned off", name)
+		}
+	}
+}
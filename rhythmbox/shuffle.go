@@ -0,0 +1,54 @@
+package rhythmbox
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Shuffle seeds are kept small so they are easy to share, "shuffle #1234"
+const maxSeed = 1000000
+
+// A rand.Rand isn't safe to share, and seeds are picked from many requests
+var seeds = struct {
+	sync.Mutex
+	rng *rand.Rand
+}{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Pick a new seed for a shuffle
+func NewSeed() int64 {
+	seeds.Lock()
+	defer seeds.Unlock()
+	return seeds.rng.Int63n(maxSeed-1) + 1
+}
+
+// Shuffle the tracks in place (Fisher-Yates). The same tracks and seed always
+// give the same order, so a shuffle can be played again from its seed.
+func ShuffleTracks(tracks []Entry, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(tracks), func(i, j int) {
+		tracks[i], tracks[j] = tracks[j], tracks[i]
+	})
+}
+
+// Clear the queue and play the tracks in the order given by the seed and mode
+// (ShuffleRandom or ShuffleSmart), a seed of 0 picks a new one. Returns the
+// seed used.
+func (r *Client) playShuffled(tracks []Entry, seed int64, mode string) int64 {
+	if seed == 0 {
+		seed = NewSeed()
+	}
+	if mode == ShuffleSmart {
+		tracks = SmartShuffleTracks(tracks, seed, r.SmartWeights, r.LastPlayed(), time.Now())
+	} else {
+		ShuffleTracks(tracks, seed)
+	}
+
+	r.ClearQueue()
+	for _, e := range tracks {
+		r.Enqueue(e.Location)
+	}
+	r.Play()
+
+	return seed
+}
@@ -0,0 +1,109 @@
+package rhythmbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testTracks(n int) []Entry {
+	tracks := make([]Entry, n)
+	for i := range tracks {
+		tracks[i] = Entry{Id: i, Title: fmt.Sprint("Track ", i), Artist: "Band", Album: "Record"}
+	}
+	return tracks
+}
+
+func trackIds(tracks []Entry) string {
+	ids := make([]string, len(tracks))
+	for i, e := range tracks {
+		ids[i] = fmt.Sprint(e.Id)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestShuffleSeed(t *testing.T) {
+	a, b, c := testTracks(20), testTracks(20), testTracks(20)
+	ShuffleTracks(a, 1234)
+	ShuffleTracks(b, 1234)
+	ShuffleTracks(c, 4321)
+
+	if trackIds(a) != trackIds(b) {
+		t.Errorf("Same seed gave %v and %v", trackIds(a), trackIds(b))
+	}
+	if trackIds(a) == trackIds(c) {
+		t.Errorf("Different seeds both gave %v", trackIds(a))
+	}
+	seen := make(map[int]bool)
+	for _, e := range a {
+		seen[e.Id] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("Lost tracks: %v", trackIds(a))
+	}
+}
+
+// Every order of three tracks should come up about as often as the others
+func TestShuffleUnbiased(t *testing.T) {
+	const runs = 60000
+	counts := make(map[string]int)
+	for seed := int64(1); seed <= runs; seed++ {
+		tracks := testTracks(3)
+		ShuffleTracks(tracks, seed)
+		counts[trackIds(tracks)]++
+	}
+
+	if len(counts) != 6 {
+		t.Fatalf("Got %v orders, want 6: %v", len(counts), counts)
+	}
+	for order, n := range counts {
+		if n < runs/6*95/100 || n > runs/6*105/100 {
+			t.Errorf("%v came up %v times in %v", order, n, runs)
+		}
+	}
+}
+
+// Playing a shuffle again from its seed queues the same order
+func TestPlayShuffledAgain(t *testing.T) {
+	r := testClient(t)
+	log := logClient(t, r)
+	id := r.Albums[0].Id
+
+	played := func(seed int64) (int64, string) {
+		ioutil.WriteFile(log, nil, 0644)
+		seed, err := r.PlayAlbumRandomly(id, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadFile(log)
+		return seed, string(data)
+	}
+
+	seed, first := played(0)
+	if seed <= 0 || seed >= maxSeed {
+		t.Fatalf("Picked seed %v", seed)
+	}
+	again, second := played(seed)
+	if again != seed || first != second {
+		t.Errorf("Seed %v played\n%v\nthen seed %v played\n%v", seed, first, again, second)
+	}
+}
+
+// Seeds are picked from many requests at once, run with -race
+func TestNewSeed(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				if seed := NewSeed(); seed <= 0 || seed >= maxSeed {
+					t.Errorf("Picked seed %v", seed)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,158 @@
+package rhythmbox
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// When the sleep timer goes off
+const (
+	SleepMinutes = "minutes" // After a number of minutes
+	SleepTrack   = "track"   // At the end of the current track
+	SleepQueue   = "queue"   // At the end of the queue
+)
+
+// The volume is faded down over this long before the timer goes off
+const SleepFade = time.Minute
+
+type SleepTimer struct {
+	Running   bool   `json:"running"`
+	Mode      string `json:"mode"`
+	Remaining int    `json:"remaining"` // Seconds until we pause
+}
+
+type sleepState struct {
+	mu     sync.Mutex
+	timer  SleepTimer
+	ends   time.Time // For SleepMinutes
+	track  int       // For SleepTrack, the track to stop after
+	volume float64   // To put back once we have paused
+	fading bool
+}
+
+func (r *Client) SleepTimer() SleepTimer {
+	r.sleep.mu.Lock()
+	defer r.sleep.mu.Unlock()
+	return r.sleep.timer
+}
+
+// Start the sleep timer, minutes is only used for SleepMinutes
+func (r *Client) StartSleep(mode string, minutes int) error {
+	np := r.NowPlaying()
+
+	r.sleep.mu.Lock()
+	if r.sleep.fading {
+		// Don't leave the volume down from the last one
+		r.SetVolume(r.sleep.volume)
+	}
+	r.sleep.timer = SleepTimer{Running: true, Mode: mode}
+	r.sleep.fading = false
+
+	switch mode {
+	case SleepMinutes:
+		if minutes <= 0 {
+			r.sleep.timer.Running = false
+			r.sleep.mu.Unlock()
+			return errors.New("Sleep for how many minutes?")
+		}
+		r.sleep.ends = time.Now().Add(time.Duration(minutes) * time.Minute)
+	case SleepTrack, SleepQueue:
+		if !np.HasTrack() {
+			r.sleep.timer.Running = false
+			r.sleep.mu.Unlock()
+			return errors.New("Nothing is playing")
+		}
+		r.sleep.track = np.Id
+	default:
+		r.sleep.timer.Running = false
+		r.sleep.mu.Unlock()
+		return errors.New("Unknown sleep timer: " + mode)
+	}
+	r.sleep.mu.Unlock()
+
+	r.sleepTick(np)
+	r.publishSleep()
+	return nil
+}
+
+func (r *Client) CancelSleep() {
+	r.sleep.mu.Lock()
+	if r.sleep.fading {
+		r.SetVolume(r.sleep.volume)
+	}
+	r.sleep.timer = SleepTimer{}
+	r.sleep.fading = false
+	r.sleep.mu.Unlock()
+
+	r.publishSleep()
+}
+
+func (r *Client) publishSleep() {
+	timer := r.SleepTimer()
+
+	r.watch.mu.Lock()
+	r.watch.state.Sleep = timer
+	state := r.watch.state
+	r.watch.mu.Unlock()
+
+	r.Events.Publish(Event{Type: EventSleep, State: state})
+}
+
+// Count down, fade and pause, called by the watcher
+func (r *Client) sleepTick(np NowPlaying) {
+	r.sleep.mu.Lock()
+	if !r.sleep.timer.Running {
+		r.sleep.mu.Unlock()
+		return
+	}
+
+	remaining := 0
+	switch r.sleep.timer.Mode {
+	case SleepMinutes:
+		remaining = int(r.sleep.ends.Sub(time.Now()) / time.Second)
+	case SleepTrack:
+		// If the track has already changed we have missed the end
+		if np.HasTrack() && np.Id == r.sleep.track {
+			remaining = np.Duration - np.Elapsed
+		}
+	case SleepQueue:
+		if np.HasTrack() {
+			remaining = np.Duration - np.Elapsed
+			for _, e := range r.UpNext() {
+				remaining += e.Duration
+			}
+		}
+	}
+	r.sleep.timer.Remaining = remaining
+
+	if remaining <= 0 {
+		r.Pause()
+		if r.sleep.fading {
+			r.SetVolume(r.sleep.volume)
+		}
+		r.sleep.timer = SleepTimer{}
+		r.sleep.fading = false
+		r.sleep.mu.Unlock()
+
+		r.publishSleep()
+		return
+	}
+
+	if remaining <= int(SleepFade/time.Second) {
+		if !r.sleep.fading {
+			// Without the volume to put back afterwards, don't fade yet
+			volume, err := r.Volume()
+			if err != nil {
+				fmt.Printf("[ERRO] Could not read the volume to fade: %v\n", err)
+				r.sleep.mu.Unlock()
+				return
+			}
+			r.sleep.volume = volume
+			r.sleep.fading = true
+		}
+		r.SetVolume(r.sleep.volume * float64(remaining) / SleepFade.Seconds())
+	}
+	r.sleep.mu.Unlock()
+}
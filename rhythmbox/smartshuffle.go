@@ -0,0 +1,199 @@
+package rhythmbox
+
+import (
+	"errors"
+	"math/bits"
+	"math/rand"
+	"time"
+)
+
+// Ways of playing things randomly, passed as mode= to the random routes
+const (
+	ShuffleRandom = "random" // Every order equally likely
+	ShuffleSmart  = "smart"  // Weighted, see SmartWeights
+)
+
+// How the smart shuffle picks the next track. Every track starts with a weight
+// of 1 and the weights below are added on top, so a track is never ruled out.
+type SmartWeights struct {
+	Rating        float64       `toml:"rating"`         // Added for a 5 star track, less for fewer stars
+	UnderPlayed   float64       `toml:"under_played"`   // Added for a track never played, halved at 1 play, and so on
+	ArtistGap     int           `toml:"artist_gap"`     // Tracks before the same artist can come up again
+	AlbumGap      int           `toml:"album_gap"`      // Tracks before the same album can come up again
+	Recent        time.Duration `toml:"recent"`         // Tracks played this recently...
+	RecentPenalty float64       `toml:"recent_penalty"` // ...have their weight multiplied by this
+}
+
+var DefaultSmartWeights = SmartWeights{
+	Rating:        2,
+	UnderPlayed:   1,
+	ArtistGap:     3,
+	AlbumGap:      5,
+	Recent:        24 * time.Hour,
+	RecentPenalty: 0.1,
+}
+
+// Weights that would rule a track out, or make no sense
+func (w SmartWeights) Validate() error {
+	switch {
+	case w.Rating < 0 || w.UnderPlayed < 0:
+		return errors.New("rating and under_played can't be negative")
+	case w.ArtistGap < 0 || w.AlbumGap < 0:
+		return errors.New("artist_gap and album_gap can't be negative")
+	case w.Recent < 0:
+		return errors.New("recent can't be negative")
+	case w.RecentPenalty <= 0:
+		return errors.New("recent_penalty has to be more than 0")
+	}
+	return nil
+}
+
+func (w SmartWeights) weight(e Entry, lastPlayed, now time.Time) float64 {
+	weight := 1 + w.Rating*float64(e.Rating)/5 + w.UnderPlayed/float64(1+e.PlayCount)
+	if !lastPlayed.IsZero() && now.Sub(lastPlayed) < w.Recent {
+		weight *= w.RecentPenalty
+	}
+	return weight
+}
+
+// Order the tracks by weighted random picks, keeping the same artist and album
+// apart where we can. lastPlayed is from the history, by TrackKey, and now is
+// what counts as recent is measured from. Like ShuffleTracks the same seed
+// gives the same order, as long as those are the same too.
+func SmartShuffleTracks(tracks []Entry, seed int64, w SmartWeights, lastPlayed map[string]time.Time, now time.Time) []Entry {
+	rng := rand.New(rand.NewSource(seed))
+
+	// The weights go in a tree so each pick is log n, and so do the counts
+	// of what is left by artist and album so we know when the gaps can't be
+	// kept without looking at every track
+	tree := make(weightTree, len(tracks)+1)
+	left := make([]bool, len(tracks))
+	artists := make(map[string]int)
+	albums := make(map[string]int)
+	both := make(map[[2]string]int)
+	for i, e := range tracks {
+		tree.add(i, w.weight(e, lastPlayed[TrackKey(e.Artist, e.Title)], now))
+		left[i] = true
+		artists[e.Artist]++
+		albums[e.Album]++
+		both[[2]string{e.Artist, e.Album}]++
+	}
+
+	ordered := make([]Entry, 0, len(tracks))
+	for len(ordered) < len(tracks) {
+		blockedArtists := recentlyPicked(ordered, w.ArtistGap, func(e Entry) string { return e.Artist })
+		blockedAlbums := recentlyPicked(ordered, w.AlbumGap, func(e Entry) string { return e.Album })
+		blocked := func(e Entry) bool {
+			return blockedArtists[e.Artist] || blockedAlbums[e.Album]
+		}
+
+		open := len(tracks) - len(ordered)
+		for a := range blockedArtists {
+			open -= artists[a]
+		}
+		for b := range blockedAlbums {
+			open -= albums[b]
+			for a := range blockedArtists {
+				open += both[[2]string{a, b}]
+			}
+		}
+
+		// Only pick from tracks that keep the gaps, unless nothing does.
+		// Drawing from everything until one does is the same as drawing from
+		// just those, but if they are only a sliver of the weight that could
+		// take a while, so give up after a few and look through them all.
+		pick := -1
+		for try := 0; try < smartTries && pick < 0; try++ {
+			i := tree.find(rng.Float64() * tree.total())
+			if i < len(tracks) && left[i] && (open == 0 || !blocked(tracks[i])) {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			pick = pickFrom(tracks, left, tree, rng, func(e Entry) bool { return open == 0 || !blocked(e) })
+		}
+
+		e := tracks[pick]
+		ordered = append(ordered, e)
+		tree.add(pick, -tree.weight(pick))
+		left[pick] = false
+		artists[e.Artist]--
+		albums[e.Album]--
+		both[[2]string{e.Artist, e.Album}]--
+	}
+
+	return ordered
+}
+
+// Draws before giving up and looking through every track
+const smartTries = 32
+
+// A weighted pick from the tracks left that are ok, by looking at each one
+func pickFrom(tracks []Entry, left []bool, tree weightTree, rng *rand.Rand, ok func(Entry) bool) int {
+	var candidates []int
+	total := 0.0
+	for i, e := range tracks {
+		if left[i] && ok(e) {
+			candidates = append(candidates, i)
+			total += tree.weight(i)
+		}
+	}
+	pick := candidates[len(candidates)-1]
+	target := rng.Float64() * total
+	for _, i := range candidates {
+		target -= tree.weight(i)
+		if target < 0 {
+			pick = i
+			break
+		}
+	}
+	return pick
+}
+
+// The artists or albums of the last gap picks
+func recentlyPicked(ordered []Entry, gap int, name func(Entry) string) map[string]bool {
+	picked := make(map[string]bool)
+	for i := len(ordered) - 1; i >= 0 && i >= len(ordered)-gap; i-- {
+		picked[name(ordered[i])] = true
+	}
+	return picked
+}
+
+// A Fenwick tree of weights, so the running totals that a weighted pick walks
+// through can be found and changed in log n. Index 0 is unused.
+type weightTree []float64
+
+func (t weightTree) add(i int, delta float64) {
+	for i++; i < len(t); i += i & -i {
+		t[i] += delta
+	}
+}
+
+func (t weightTree) sum(i int) float64 {
+	total := 0.0
+	for ; i > 0; i -= i & -i {
+		total += t[i]
+	}
+	return total
+}
+
+func (t weightTree) total() float64 {
+	return t.sum(len(t) - 1)
+}
+
+func (t weightTree) weight(i int) float64 {
+	return t.sum(i+1) - t.sum(i)
+}
+
+// The first index where the running total goes past target
+func (t weightTree) find(target float64) int {
+	i := 0
+	for step := bits.Len(uint(len(t))); step >= 0; step-- {
+		next := i + 1<<uint(step)
+		if next < len(t) && t[next] <= target {
+			i = next
+			target -= t[i]
+		}
+	}
+	return i
+}
@@ -0,0 +1,105 @@
+package rhythmbox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// So many tracks by each artist, each artist with their own album
+func smartTracks(counts ...int) []Entry {
+	var tracks []Entry
+	for a, n := range counts {
+		for i := 0; i < n; i++ {
+			tracks = append(tracks, Entry{
+				Id:     len(tracks),
+				Title:  fmt.Sprint("Track ", i),
+				Artist: fmt.Sprint("Artist ", a),
+				Album:  fmt.Sprint("Album ", a),
+			})
+		}
+	}
+	return tracks
+}
+
+func TestSmartShuffleSeed(t *testing.T) {
+	tracks := smartTracks(6, 6, 6, 6, 6)
+	now := time.Now()
+	last := map[string]time.Time{TrackKey("Artist 0", "Track 0"): now.Add(-time.Hour)}
+
+	a := SmartShuffleTracks(tracks, 99, DefaultSmartWeights, last, now)
+	b := SmartShuffleTracks(tracks, 99, DefaultSmartWeights, last, now)
+	c := SmartShuffleTracks(tracks, 100, DefaultSmartWeights, last, now)
+
+	if trackIds(a) != trackIds(b) {
+		t.Errorf("Same seed gave %v and %v", trackIds(a), trackIds(b))
+	}
+	if trackIds(a) == trackIds(c) {
+		t.Errorf("Different seeds both gave %v", trackIds(a))
+	}
+	seen := make(map[int]bool)
+	for _, e := range a {
+		seen[e.Id] = true
+	}
+	if len(seen) != len(tracks) {
+		t.Errorf("Lost tracks: %v", trackIds(a))
+	}
+}
+
+// The same artist only comes up again within the gap when every track left
+// is by an artist inside it
+func TestSmartShuffleArtistGap(t *testing.T) {
+	w := DefaultSmartWeights
+	w.ArtistGap, w.AlbumGap = 3, 0
+	tracks := smartTracks(13, 5, 5, 5)
+
+	for seed := int64(1); seed <= 200; seed++ {
+		ordered := SmartShuffleTracks(tracks, seed, w, nil, time.Now())
+		for i, e := range ordered {
+			blocked := recentlyPicked(ordered[:i], w.ArtistGap, func(e Entry) string { return e.Artist })
+			if !blocked[e.Artist] {
+				continue
+			}
+			for _, o := range ordered[i:] {
+				if !blocked[o.Artist] {
+					t.Fatalf("Seed %v: %v at %v when %v was left", seed, e.Artist, i, o.Artist)
+				}
+			}
+		}
+	}
+}
+
+// A 5 star track has 11 times the weight of an unrated one, and one played
+// in the last day a tenth of the weight
+func TestSmartShuffleWeights(t *testing.T) {
+	w := SmartWeights{Rating: 10, Recent: time.Hour, RecentPenalty: 0.1}
+	now := time.Now()
+	tracks := smartTracks(1, 1)
+
+	firsts := func(last map[string]time.Time) int {
+		n := 0
+		for seed := int64(1); seed <= 1000; seed++ {
+			if SmartShuffleTracks(tracks, seed, w, last, now)[0].Id == 0 {
+				n++
+			}
+		}
+		return n
+	}
+
+	tracks[0].Rating = 5
+	if n := firsts(nil); n < 870 || n > 960 {
+		t.Errorf("5 star track first %v times in 1000, want about 917", n)
+	}
+
+	tracks[0].Rating = 0
+	last := map[string]time.Time{TrackKey(tracks[0].Artist, tracks[0].Title): now.Add(-time.Minute)}
+	if n := firsts(last); n < 50 || n > 130 {
+		t.Errorf("Recently played track first %v times in 1000, want about 91", n)
+	}
+
+	// Long enough ago doesn't count
+	last[TrackKey(tracks[0].Artist, tracks[0].Title)] = now.Add(-2 * time.Hour)
+	if n := firsts(last); n < 430 || n > 570 {
+		t.Errorf("Track played earlier first %v times in 1000, want about 500", n)
+	}
+}
@@ -0,0 +1,235 @@
+package rhythmbox
+
+import (
+	"sort"
+	"time"
+)
+
+// Periods stats can be worked out for
+const (
+	StatsWeek  = "week"
+	StatsMonth = "month"
+	StatsYear  = "year"
+)
+
+// A track first played within this long of turning up in the library is a
+// discovery
+const DiscoveryWindow = 30 * 24 * time.Hour
+
+// How many of each top list to keep
+const statsTop = 10
+
+// Plays of one artist, album, genre or track
+type Count struct {
+	Name     string `json:"name"`
+	Plays    int    `json:"plays"`
+	Listened int    `json:"listened"` // Seconds
+	Skipped  int    `json:"skipped"`
+}
+
+func (c Count) SkipRate() int {
+	if c.Plays == 0 {
+		return 0
+	}
+	return c.Skipped * 100 / c.Plays
+}
+
+func (c Count) ListenedString() string {
+	return FormatDuration(c.Listened)
+}
+
+type DayTotal struct {
+	Day      time.Time `json:"day"`
+	Plays    int       `json:"plays"`
+	Listened int       `json:"listened"` // Seconds
+}
+
+type Stats struct {
+	Period      string     `json:"period"`
+	From        time.Time  `json:"from"`
+	To          time.Time  `json:"to"`
+	Plays       int        `json:"plays"`
+	Listened    int        `json:"listened"` // Seconds
+	Skipped     int        `json:"skipped"`
+	TopArtists  []Count    `json:"topArtists"`
+	TopAlbums   []Count    `json:"topAlbums"`
+	TopGenres   []Count    `json:"topGenres"`
+	TopTracks   []Count    `json:"topTracks"`
+	Days        []DayTotal `json:"days"`
+	BusiestDay  DayTotal   `json:"busiestDay"`
+	Discoveries []Play     `json:"discoveries"`
+	NewArtists  int        `json:"newArtists"` // Played for the first time ever
+}
+
+func (s Stats) SkipRate() int {
+	return Count{Plays: s.Plays, Skipped: s.Skipped}.SkipRate()
+}
+
+func (s Stats) ListenedString() string {
+	return FormatDuration(s.Listened)
+}
+
+// The most listened day, as a share of it, for drawing bars
+func (s Stats) DayPercent(d DayTotal) int {
+	if s.BusiestDay.Listened == 0 {
+		return 0
+	}
+	return d.Listened * 100 / s.BusiestDay.Listened
+}
+
+type ByPlays []Count
+
+func (a ByPlays) Len() int      { return len(a) }
+func (a ByPlays) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByPlays) Less(i, j int) bool {
+	if a[i].Plays != a[j].Plays {
+		return a[i].Plays > a[j].Plays
+	}
+	return a[i].Name < a[j].Name
+}
+
+// Where a period starts, counting back offset periods from the one t is in.
+// Weeks start on a Monday.
+func PeriodStart(period string, t time.Time, offset int) time.Time {
+	y, m, d := t.Date()
+	switch period {
+	case StatsWeek:
+		monday := d - (int(t.Weekday())+6)%7
+		return time.Date(y, m, monday-7*offset, 0, 0, 0, 0, t.Location())
+	case StatsMonth:
+		return time.Date(y, m-time.Month(offset), 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y-offset, time.January, 1, 0, 0, 0, 0, t.Location())
+}
+
+func periodEnd(period string, from time.Time) time.Time {
+	switch period {
+	case StatsWeek:
+		return from.AddDate(0, 0, 7)
+	case StatsMonth:
+		return from.AddDate(0, 1, 0)
+	}
+	return from.AddDate(1, 0, 0)
+}
+
+// Work out the stats for a week, month or year, offset periods back from now
+func (r *Client) Stats(period string, offset int) Stats {
+	return r.statsAt(period, offset, time.Now())
+}
+
+func (r *Client) statsAt(period string, offset int, now time.Time) Stats {
+	if period != StatsWeek && period != StatsMonth {
+		period = StatsYear
+	}
+	from := PeriodStart(period, now, offset)
+	s := Stats{Period: period, From: from, To: periodEnd(period, from)}
+
+	plays := r.History(HistoryFilter{})
+
+	artists := make(map[string]*Count)
+	albums := make(map[string]*Count)
+	genres := make(map[string]*Count)
+	tracks := make(map[string]*Count)
+	days := make(map[string]*DayTotal)
+	seenTracks := make(map[string]bool)
+	seenArtists := make(map[string]bool)
+
+	add := func(counts map[string]*Count, name string, p Play) {
+		if len(name) == 0 {
+			return
+		}
+		c, ok := counts[name]
+		if !ok {
+			c = &Count{Name: name}
+			counts[name] = c
+		}
+		c.Plays++
+		c.Listened += p.Listened
+		if p.Skipped {
+			c.Skipped++
+		}
+	}
+
+	// Oldest first, so we know which plays are firsts
+	for i := len(plays) - 1; i >= 0; i-- {
+		p := plays[i]
+		track := TrackKey(p.Artist, p.Title)
+		firstPlay := !seenTracks[track]
+		firstArtist := !seenArtists[p.Artist]
+		seenTracks[track] = true
+		seenArtists[p.Artist] = true
+
+		if p.Started.Before(s.From) || !p.Started.Before(s.To) {
+			continue
+		}
+
+		s.Plays++
+		s.Listened += p.Listened
+		if p.Skipped {
+			s.Skipped++
+		}
+		add(artists, p.Artist, p)
+		add(albums, p.Album, p)
+		add(genres, p.Genre, p)
+		add(tracks, track, p)
+
+		key := p.Started.Format("2006-01-02")
+		if days[key] == nil {
+			y, m, d := p.Started.Date()
+			days[key] = &DayTotal{Day: time.Date(y, m, d, 0, 0, 0, 0, p.Started.Location())}
+		}
+		days[key].Plays++
+		days[key].Listened += p.Listened
+
+		if firstArtist {
+			s.NewArtists++
+		}
+		if firstPlay && r.isDiscovery(p) {
+			s.Discoveries = append(s.Discoveries, p)
+		}
+	}
+
+	s.TopArtists = topCounts(artists)
+	s.TopAlbums = topCounts(albums)
+	s.TopGenres = topCounts(genres)
+	s.TopTracks = topCounts(tracks)
+
+	// Every day in the period, even the quiet ones
+	for d := s.From; d.Before(s.To); d = d.AddDate(0, 0, 1) {
+		day := DayTotal{Day: d}
+		if t, ok := days[d.Format("2006-01-02")]; ok {
+			day = *t
+		}
+		s.Days = append(s.Days, day)
+		if day.Listened > s.BusiestDay.Listened {
+			s.BusiestDay = day
+		}
+	}
+
+	return s
+}
+
+// Whether the track was new to the library when it was played
+func (r *Client) isDiscovery(p Play) bool {
+	if p.Id < 0 || p.Id >= len(r.Db.Entries) {
+		return false
+	}
+	e := r.Db.Entries[p.Id]
+	if e.Title != p.Title || e.FirstSeen == 0 {
+		return false
+	}
+	added := time.Unix(int64(e.FirstSeen), 0)
+	return p.Started.Sub(added) < DiscoveryWindow
+}
+
+func topCounts(counts map[string]*Count) []Count {
+	top := make([]Count, 0, len(counts))
+	for _, c := range counts {
+		top = append(top, *c)
+	}
+	sort.Sort(ByPlays(top))
+	if len(top) > statsTop {
+		top = top[:statsTop]
+	}
+	return top
+}
@@ -0,0 +1,171 @@
+package rhythmbox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func day(y int, m time.Month, d, hour int) time.Time {
+	return time.Date(y, m, d, hour, 0, 0, 0, time.UTC)
+}
+
+func TestPeriodStart(t *testing.T) {
+	wednesday := day(2025, time.March, 12, 15)
+	tests := []struct {
+		period string
+		t      time.Time
+		offset int
+		want   time.Time
+	}{
+		{StatsWeek, wednesday, 0, day(2025, time.March, 10, 0)},
+		{StatsWeek, wednesday, 1, day(2025, time.March, 3, 0)},
+		{StatsWeek, day(2025, time.March, 10, 0), 0, day(2025, time.March, 10, 0)},
+		{StatsWeek, day(2025, time.March, 16, 23), 0, day(2025, time.March, 10, 0)},
+		{StatsWeek, day(2025, time.March, 1, 12), 0, day(2025, time.February, 24, 0)},
+		{StatsWeek, day(2025, time.January, 2, 12), 0, day(2024, time.December, 30, 0)},
+		{StatsMonth, wednesday, 0, day(2025, time.March, 1, 0)},
+		{StatsMonth, wednesday, 3, day(2024, time.December, 1, 0)},
+		{StatsMonth, day(2025, time.March, 31, 23), 1, day(2025, time.February, 1, 0)},
+		{StatsYear, wednesday, 0, day(2025, time.January, 1, 0)},
+		{StatsYear, wednesday, 1, day(2024, time.January, 1, 0)},
+	}
+
+	for _, tt := range tests {
+		if got := PeriodStart(tt.period, tt.t, tt.offset); !got.Equal(tt.want) {
+			t.Errorf("%v of %v, %v back: got %v, want %v", tt.period, tt.t, tt.offset, got, tt.want)
+		}
+	}
+}
+
+// The library from testClient with a short history. Zed was first played last
+// year, Amy and Mo are new this month, Aalbum 2 was added to the library just
+// before it was played.
+func statsClient(t *testing.T) *Client {
+	r := testClient(t)
+	r.Db.Entries[4].FirstSeen = int(day(2025, time.March, 1, 0).Unix())
+
+	play := func(id int, started time.Time, listened int, skipped bool) Play {
+		e := r.Db.Entries[id]
+		return Play{Id: id, Title: e.Title, Artist: e.Artist, Album: e.Album, Genre: e.Genre,
+			Started: started, Duration: e.Duration, Listened: listened, Skipped: skipped}
+	}
+	// Oldest first, as they are recorded
+	r.history.plays = []Play{
+		play(0, day(2024, time.December, 30, 20), 200, false),
+		play(0, day(2025, time.March, 10, 10), 200, false),
+		play(3, day(2025, time.March, 10, 11), 50, true),
+		play(4, day(2025, time.March, 11, 9), 200, false),
+		play(3, day(2025, time.March, 11, 10), 200, false),
+		play(6, day(2025, time.March, 17, 0), 100, false),
+	}
+	return r
+}
+
+func TestStats(t *testing.T) {
+	r := statsClient(t)
+	now := day(2025, time.March, 12, 15)
+
+	tests := []struct {
+		period      string
+		offset      int
+		plays       int
+		listened    int
+		skipped     int
+		days        int
+		busiest     time.Time
+		topArtist   string
+		topTrack    string
+		newArtists  int
+		discoveries int
+	}{
+		{StatsWeek, 0, 4, 650, 1, 7, day(2025, time.March, 11, 0), "Amy", "Amy - Aalbum 1", 1, 1},
+		{StatsWeek, 1, 0, 0, 0, 7, time.Time{}, "", "", 0, 0},
+		{StatsMonth, 0, 5, 750, 1, 31, day(2025, time.March, 11, 0), "Amy", "Amy - Aalbum 1", 2, 1},
+		{StatsMonth, 3, 1, 200, 0, 31, day(2024, time.December, 30, 0), "Zed", "Zed - Zalbum 1", 1, 0},
+		{StatsYear, 0, 5, 750, 1, 365, day(2025, time.March, 11, 0), "Amy", "Amy - Aalbum 1", 2, 1},
+		// Anything else is a year
+		{"decade", 1, 1, 200, 0, 366, day(2024, time.December, 30, 0), "Zed", "Zed - Zalbum 1", 1, 0},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("%v %v back", tt.period, tt.offset)
+		s := r.statsAt(tt.period, tt.offset, now)
+		if s.Plays != tt.plays || s.Listened != tt.listened || s.Skipped != tt.skipped {
+			t.Errorf("%v: got %v plays, %v listened and %v skipped, want %v, %v and %v",
+				name, s.Plays, s.Listened, s.Skipped, tt.plays, tt.listened, tt.skipped)
+		}
+		if len(s.Days) != tt.days || !s.BusiestDay.Day.Equal(tt.busiest) {
+			t.Errorf("%v: got %v days, busiest %v, want %v, %v", name, len(s.Days), s.BusiestDay.Day, tt.days, tt.busiest)
+		}
+		if len(s.Days) > 0 && (!s.Days[0].Day.Equal(s.From) || !s.Days[len(s.Days)-1].Day.AddDate(0, 0, 1).Equal(s.To)) {
+			t.Errorf("%v: days run %v to %v, want %v up to %v", name, s.Days[0].Day, s.Days[len(s.Days)-1].Day, s.From, s.To)
+		}
+		top := func(c []Count) string {
+			if len(c) == 0 {
+				return ""
+			}
+			return c[0].Name
+		}
+		if top(s.TopArtists) != tt.topArtist || top(s.TopTracks) != tt.topTrack {
+			t.Errorf("%v: got top %q and %q, want %q and %q", name, top(s.TopArtists), top(s.TopTracks), tt.topArtist, tt.topTrack)
+		}
+		if s.NewArtists != tt.newArtists || len(s.Discoveries) != tt.discoveries {
+			t.Errorf("%v: got %v new artists and %v discoveries, want %v and %v",
+				name, s.NewArtists, len(s.Discoveries), tt.newArtists, tt.discoveries)
+		}
+	}
+}
+
+// The week's counts in detail, a play at midnight on the Monday after is next
+// week's
+func TestStatsCounts(t *testing.T) {
+	r := statsClient(t)
+	s := r.statsAt(StatsWeek, 0, day(2025, time.March, 12, 15))
+
+	want := []Count{{Name: "Amy", Plays: 3, Listened: 450, Skipped: 1}, {Name: "Zed", Plays: 1, Listened: 200}}
+	if fmt.Sprint(s.TopArtists) != fmt.Sprint(want) {
+		t.Errorf("Got artists %v, want %v", s.TopArtists, want)
+	}
+	if got := s.TopArtists[0].SkipRate(); got != 33 {
+		t.Errorf("Amy's skip rate is %v, want 33", got)
+	}
+	if s.Days[0].Plays != 2 || s.Days[1].Plays != 2 || s.Days[6].Plays != 0 {
+		t.Errorf("Got days %+v", s.Days)
+	}
+	if got := s.DayPercent(s.Days[0]); got != 62 {
+		t.Errorf("Monday is %v%% of the busiest day, want 62", got)
+	}
+	if len(s.Discoveries) != 1 || s.Discoveries[0].Title != "Aalbum 2" {
+		t.Errorf("Got discoveries %+v, want Aalbum 2", s.Discoveries)
+	}
+}
+
+func TestTopCounts(t *testing.T) {
+	counts := make(map[string]*Count)
+	for i := 0; i < statsTop+2; i++ {
+		name := fmt.Sprintf("artist %02d", i)
+		counts[name] = &Count{Name: name, Plays: 1}
+	}
+	counts["artist 11"].Plays = 3
+	counts["artist 10"].Plays = 2
+
+	top := topCounts(counts)
+	if len(top) != statsTop {
+		t.Fatalf("Got %v, want the top %v", len(top), statsTop)
+	}
+	// Most plays first, then by name
+	want := []string{"artist 11", "artist 10", "artist 00", "artist 01"}
+	for i, name := range want {
+		if top[i].Name != name {
+			t.Errorf("Number %v is %v, want %v", i+1, top[i].Name, name)
+		}
+	}
+	if top[statsTop-1].Name != "artist 07" {
+		t.Errorf("Last is %v, want artist 07", top[statsTop-1].Name)
+	}
+
+	if len(topCounts(nil)) != 0 {
+		t.Error("Something from nothing")
+	}
+}